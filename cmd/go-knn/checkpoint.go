@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// checkpoint is what is done of one fold of a work: the learned fold model
+// once weights are learned, and the fold's metrics once it is evaluated.
+type checkpoint struct {
+	// Flags are the flags the results depend on, see checkpointFlags.
+	Flags string `json:"flags"`
+	Work  string `json:"work"`
+	foldModel
+	// Tuning is the held-out accuracy of the tuned hyperparameters per metric.
+	Tuning []float64 `json:"tuning,omitempty"`
+	// Results are attack -> tp, fpp, fnp, fn, tn of the fold.
+	Results map[string][5]int `json:"results,omitempty"`
+}
+
+// checkpointFlags are the values of the flags that results depend on, in
+// the order of flagGroups.
+func checkpointFlags() string {
+	var values []string
+	for _, group := range []string{"dataset", "attack", "wllcc", "stream", "split"} {
+		for _, name := range flagGroups[group] {
+			if name != "wtrace" {
+				values = append(values, name+"="+flag.Lookup(name).Value.String())
+			}
+		}
+	}
+	values = append(values, "load-weights="+flag.Lookup("load-weights").Value.String())
+	return strings.Join(values, " ")
+}
+
+func checkpointName(work string, fold int) string {
+	return path.Join(*checkpointDir, fmt.Sprintf("%s-fold%d.json",
+		strings.NewReplacer("/", "_", "\\", "_").Replace(work), fold))
+}
+
+// saveCheckpoint writes the checkpoint of a fold, replacing any earlier one
+// only once completely written.
+func saveCheckpoint(work string, fold int, s *scaler, weights [][]float64,
+	params []wllccParams, tuned []tuning, results map[string]metrics) error {
+	c := checkpoint{
+		Flags:     checkpointFlags(),
+		Work:      work,
+		foldModel: newFoldModel(fold, *sites**instances+*open, s, weights, params),
+	}
+	if *tune != "" {
+		for _, t := range tuned {
+			c.Tuning = append(c.Tuning, t.score)
+		}
+	}
+	if results != nil {
+		c.Results = make(map[string][5]int)
+		for attack, m := range results {
+			c.Results[attack] = counts(m)
+		}
+	}
+
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	name := checkpointName(work, fold)
+	if err = ioutil.WriteFile(name+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// loadCheckpoint reads the checkpoint of a fold, nil if there is none. The
+// checkpoint has to be of a run with the same flags.
+func loadCheckpoint(work string, fold int) (*checkpoint, error) {
+	data, err := ioutil.ReadFile(checkpointName(work, fold))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	c := new(checkpoint)
+	if err = json.Unmarshal(data, c); err != nil {
+		return nil, fmt.Errorf("failed to parse checkpoint of fold %d (%s)", fold, err)
+	}
+	if c.Work != work || c.Fold != fold {
+		return nil, fmt.Errorf("checkpoint of fold %d is for work %s and fold %d",
+			fold, c.Work, c.Fold)
+	}
+	if flags := checkpointFlags(); c.Flags != flags {
+		// name the flags that differ
+		before, now := strings.Fields(c.Flags), strings.Fields(flags)
+		var differ []string
+		for i := 0; i < len(before) && i < len(now); i++ {
+			if before[i] != now[i] {
+				differ = append(differ, before[i])
+			}
+		}
+		return nil, fmt.Errorf("checkpoint of fold %d is of a run with other flags (%s)",
+			fold, strings.Join(differ, " "))
+	}
+	var training []int
+	for i := 0; i < *sites**instances+*open; i++ {
+		if instanceForTraining(i, fold) {
+			training = append(training, i)
+		}
+	}
+	if !reflect.DeepEqual(c.Training, training) {
+		return nil, fmt.Errorf("checkpoint of fold %d is of another split", fold)
+	}
+	if len(c.Metrics) != len(distMetrics) {
+		return nil, fmt.Errorf("checkpoint of fold %d has %d metrics, run has %d",
+			fold, len(c.Metrics), len(distMetrics))
+	}
+	for m := 0; m < len(distMetrics); m++ {
+		if c.Metrics[m].Metric != distMetrics[m].Name() {
+			return nil, fmt.Errorf("checkpoint of fold %d has metric %s, expected %s",
+				fold, c.Metrics[m].Metric, distMetrics[m].Name())
+		}
+		if _, err = c.weights(distMetrics[m].Name()); err != nil {
+			return nil, err
+		}
+	}
+	if *tune != "" && len(c.Tuning) != len(distMetrics) {
+		return nil, fmt.Errorf("checkpoint of fold %d is not tuned", fold)
+	}
+	return c, nil
+}
+
+// foldResults are the metrics of a fold in a checkpoint.
+func (c *checkpoint) foldResults() map[string]metrics {
+	return fromCounts(c.Results)
+}
+
+// counts are metrics as tp, fpp, fnp, fn, tn, for encoding.
+func counts(m metrics) [5]int {
+	return [5]int{m.tp, m.fpp, m.fnp, m.fn, m.tn}
+}
+
+// fromCounts decodes the counts of attacks.
+func fromCounts(c map[string][5]int) map[string]metrics {
+	results := make(map[string]metrics)
+	for attack, r := range c {
+		results[attack] = metrics{tp: r[0], fpp: r[1], fnp: r[2], fn: r[3], tn: r[4]}
+	}
+	return results
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// classifier classifies new instances with one fold of a saved model, using
+// the same distances and voting as when evaluating.
+type classifier struct {
+	model  *modelFile
+	work   *workModel
+	fold   *foldModel
+	metric Metric
+	weight []float64
+	scaler *scaler
+	k      int
+
+	// feat and openfeat are the normalized instances of the work, of which
+	// those in the training fold are the reference instances
+	feat, openfeat [][]float64
+	training       []bool
+}
+
+// neighbour is a reference instance close to a classified instance.
+type neighbour struct {
+	File     string  `json:"file"`
+	Class    int     `json:"class"`
+	Site     string  `json:"site"`
+	Distance float64 `json:"distance"`
+}
+
+// candidate is a class ranked by the distance to its closest reference.
+type candidate struct {
+	Class    int     `json:"class"`
+	Site     string  `json:"site"`
+	Distance float64 `json:"distance"`
+}
+
+// prediction is the outcome of classifying an instance.
+type prediction struct {
+	Class      int         `json:"class"`
+	Site       string      `json:"site"`
+	Monitored  bool        `json:"monitored"`
+	Confidence float64     `json:"confidence"` // fraction of neighbours of the class
+	Neighbours []neighbour `json:"neighbours"`
+	Candidates []candidate `json:"candidates"`
+}
+
+// newClassifier sets up classification with the given work, fold, and
+// metric of a model. Reference instances are read from datadir (if set,
+// otherwise from the dir of the work) unless embedded in the model.
+func newClassifier(mf *modelFile, work string, fold int, metric string, k int,
+	datadir string) (c *classifier, err error) {
+	c = &classifier{model: mf, k: k}
+	if c.k <= 0 {
+		c.k = mf.KMin
+	}
+	if c.work, err = mf.work(work); err != nil {
+		return nil, err
+	}
+	if c.fold, err = c.work.fold(fold); err != nil {
+		return nil, err
+	}
+	if c.metric, err = getMetric(metric); err != nil {
+		return nil, err
+	}
+	if c.weight, err = c.fold.weights(metric); err != nil {
+		return nil, err
+	}
+	c.scaler = c.fold.scaler()
+	if datadir == "" {
+		datadir = c.work.Dir
+	}
+
+	// read (or take the embedded) reference instances
+	c.training = make([]bool, len(c.work.Instances))
+	for _, i := range c.fold.Training {
+		if i < 0 || i >= len(c.training) {
+			return nil, fmt.Errorf("training instance %d out of range", i)
+		}
+		c.training[i] = true
+	}
+	for i, ref := range c.work.Instances {
+		f := ref.Features
+		if f == nil && c.training[i] {
+			if f, err = readFeatureFile(path.Join(datadir, ref.File)); err != nil {
+				return nil, err
+			}
+		}
+		if f == nil {
+			f = make([]float64, FeatNum) // not a reference, never compared to
+		} else if len(f) != FeatNum {
+			return nil, fmt.Errorf("instance %s has %d features, expected %d",
+				ref.File, len(f), FeatNum)
+		}
+		if ref.Class < mf.Sites {
+			if len(c.openfeat) > 0 {
+				return nil, fmt.Errorf("instances in model not ordered monitored first")
+			}
+			c.feat = append(c.feat, c.scaler.transform(f))
+		} else {
+			c.openfeat = append(c.openfeat, c.scaler.transform(f))
+		}
+	}
+
+	return c, nil
+}
+
+// site is the name of a class: the label of the site in the manifest, or the
+// site number as in the feature files.
+func (c *classifier) site(class int) string {
+	if class >= c.model.Sites {
+		return "unmonitored"
+	}
+	if class < len(c.work.Labels) {
+		return c.work.Labels[class]
+	}
+	return strconv.Itoa(c.model.ROffset + class + 1)
+}
+
+// classify classifies the (unnormalized) features of an instance, ranking up
+// to n candidate classes.
+func (c *classifier) classify(feat []float64, n int) (p prediction) {
+	distList := distances(c.scaler.transform(feat), c.feat, c.openfeat, c.weight,
+		c.metric, func(i int) bool {
+			return !c.training[i]
+		})
+
+	// the closest distance for each class, ranked
+	best := make(map[int]float64)
+	for i, d := range distList {
+		if d == math.MaxFloat64 {
+			continue
+		}
+		class := c.work.Instances[i].Class
+		if min, exists := best[class]; !exists || d < min {
+			best[class] = d
+		}
+	}
+	for class, d := range best {
+		p.Candidates = append(p.Candidates,
+			candidate{Class: class, Site: c.site(class), Distance: d})
+	}
+	sort.Slice(p.Candidates, func(i, j int) bool {
+		if p.Candidates[i].Distance == p.Candidates[j].Distance {
+			return p.Candidates[i].Class < p.Candidates[j].Class
+		}
+		return p.Candidates[i].Distance < p.Candidates[j].Distance
+	})
+	if len(p.Candidates) > n {
+		p.Candidates = p.Candidates[:n]
+	}
+
+	// the Wa-kNN verdict from the k closest neighbours
+	var classes []int
+	closest := append([]float64(nil), distList...)
+	for _, i := range nearest(distList, c.k) {
+		ref := c.work.Instances[i]
+		classes = append(classes, ref.Class)
+		p.Neighbours = append(p.Neighbours, neighbour{
+			File:     ref.File,
+			Class:    ref.Class,
+			Site:     c.site(ref.Class),
+			Distance: closest[i],
+		})
+	}
+	p.Class = vote(classes, c.k, c.model.Sites)
+	p.Site = c.site(p.Class)
+	p.Monitored = p.Class < c.model.Sites
+	for _, class := range classes {
+		if class == p.Class {
+			p.Confidence++
+		}
+	}
+	p.Confidence /= float64(len(classes))
+	return
+}
+
+// readInstance reads the features of an instance: from a feature file if
+// named with FeatureSuffix, otherwise extracted from a cell trace.
+func readInstance(filename string) ([]float64, error) {
+	if strings.HasSuffix(filename, FeatureSuffix) {
+		feat, err := readFeatureFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		if len(feat) != FeatNum {
+			return nil, fmt.Errorf("%s has %d features, expected %d",
+				filename, len(feat), FeatNum)
+		}
+		return feat, nil
+	}
+	times, sizes, err := readTrace(filename)
+	if err != nil {
+		return nil, err
+	}
+	return extractFeatures(times, sizes)
+}
+
+// classifierFlags are the flags to set up a classifier from a model.
+type classifierFlags struct {
+	model, work, metric, data *string
+	fold, k, n                *int
+}
+
+func addClassifierFlags(fs *flag.FlagSet) (f classifierFlags) {
+	f.model = fs.String("model", "", "the model file to classify with")
+	f.work = fs.String("work", "", "the work in the model (default: the only one)")
+	f.fold = fs.Int("fold", 0, "the fold in the model to use weights and references of")
+	f.metric = fs.String("metric", "l1", "the metric in the model to classify with")
+	f.k = fs.Int("k", 0, "the number of neighbours that have to agree (default: the model's smallest k)")
+	f.n = fs.Int("n", 5, "the number of candidate sites to list")
+	f.data = fs.String("data", "", "folder with the reference features (default: the model's)")
+	return
+}
+
+// load loads the model file and sets up a classifier with it.
+func (f classifierFlags) load(modelName string) (*classifier, error) {
+	mf, err := loadModel(modelName)
+	if err != nil {
+		return nil, err
+	}
+	return newClassifier(mf, *f.work, *f.fold, *f.metric, *f.k, *f.data)
+}
+
+// classifyMain is the classify subcommand: score traces or feature files
+// against a saved model.
+func classifyMain(args []string) {
+	fs := newFlagSet("classify")
+	cf := addClassifierFlags(fs)
+	every := fs.Int("every", 0, "also predict after every this many cells of a trace")
+	everyTime := fs.Float64("every-time", 0, "also predict after every this many seconds of a trace")
+	points := fs.Int("points", 10, "the number of streaming predictions to make per trace")
+	fs.Parse(args)
+	if *cf.model == "" {
+		usageError(fs, "need to specify -model")
+	}
+	if fs.NArg() == 0 {
+		usageError(fs, "need to specify traces or feature files")
+	}
+
+	if *every > 0 && *everyTime > 0 {
+		log.Fatalf("stream by either cells or time, not both")
+	}
+	c, err := cf.load(*cf.model)
+	if err != nil {
+		log.Fatalf("failed to set up classifier (%s)", err)
+	}
+
+	failed := 0
+	for _, filename := range fs.Args() {
+		if (*every > 0 || *everyTime > 0) && !strings.HasSuffix(filename, FeatureSuffix) {
+			// predictions as the trace streams in
+			times, sizes, err := readTrace(filename)
+			if err != nil {
+				log.Printf("failed to read %s (%s)", filename, err)
+				failed++
+				continue
+			}
+			for _, pre := range streamPrefixes(times, sizes, *every, *everyTime, *points) {
+				fmt.Printf("%s@%s: %s\n", filename, pre.label,
+					verdict(c.classify(pre.feat, *cf.n)))
+			}
+		}
+
+		feat, err := readInstance(filename)
+		if err != nil {
+			log.Printf("failed to read %s (%s)", filename, err)
+			failed++
+			continue
+		}
+		p := c.classify(feat, *cf.n)
+		fmt.Printf("%s: %s (k=%d)\n", filename, verdict(p), c.k)
+		for i, cand := range p.Candidates {
+			fmt.Printf("\t%d\t%s\t%s\n", i+1, cand.Site,
+				strconv.FormatFloat(cand.Distance, 'f', -1, 64))
+		}
+	}
+	if failed > 0 {
+		log.Printf("failed to classify %d of %d files", failed, fs.NArg())
+		os.Exit(1)
+	}
+}
+
+func verdict(p prediction) string {
+	if p.Monitored {
+		return "monitored site " + p.Site
+	}
+	return "unmonitored"
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// command is a go-knn subcommand.
+type command struct {
+	name, args, summary string
+	run                 func(args []string)
+}
+
+var commands []command
+
+func init() {
+	// set in init as the commands refer to commands for their usage
+	commands = []command{
+		{"extract", "[flags] folder", "extract features from cell traces", extractMain},
+		{"train", "-sites n -instances n [flags] datadir", "learn weights for all folds and write a model", trainMain},
+		{"eval", "-sites n -instances n [flags] datadir", "evaluate the attack with k-fold cross-validation", evalMain},
+		{"run", "[flags] experiment.json", "run the experiments of a config file with a combined report", runMain},
+		{"worker", "-coordinator url -data dir [flags]", "test units handed out by eval -coordinate", workerMain},
+		{"classify", "-model file [flags] trace|features ...", "score traces against a saved model", classifyMain},
+		{"serve", "-model file [flags]", "serve classification over HTTP/JSON", serveMain},
+		{"inspect", "[flags] model|datadir", "describe a model file or check a dataset folder", inspectMain},
+		{"validate", "[flags] datadir", "check a dataset folder, failing on problems", validateMain},
+		{"dedup", "[flags] datadir", "find duplicate and near-duplicate instances", dedupMain},
+		{"convert", "-sites n -instances n [flags] src dst", "convert a dataset from Wang's layout to go-knn's", convertMain},
+	}
+}
+
+// flagGroups are the names of flags (defined on flag.CommandLine) shared by
+// subcommands.
+var flagGroups = map[string][]string{
+	"dataset": {"sites", "instances", "open", "open-instances", "roffset", "manifest", "test-data"},
+	"attack":  {"wKmin", "wKmax", "wKstep", "metric", "norm", "sweep-open", "sweep-open-test"},
+	"wllcc": {"r", "wrate", "wreco", "winitmin", "winitmax", "wtrace", "estop", "eholdout",
+		"eevery", "tune", "tunefolds", "tunetrials", "tunerate", "tunereco", "tuneinit"},
+	"stream": {"traces", "stream", "stream-time", "stream-points", "prefixes"},
+	"split": {"folds", "split", "repeats", "holdout", "seed", "split-file", "train-instances", "open-by-number", "unseen-open",
+		"period", "train-periods", "test-periods", "timestamps"},
+	"experiment": {"f", "threads", "out", "curve", "checkpoint", "resume", "coordinate", "unit", "lease", "verbose", "quiet", "load-weights", "embed"},
+}
+
+// newFlagSet creates the flag set of a subcommand, sharing the flags of the
+// given groups with the top-level flags.
+func newFlagSet(name string, groups ...string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	for _, group := range groups {
+		for _, n := range flagGroups[group] {
+			f := flag.Lookup(n)
+			fs.Var(f.Value, f.Name, f.Usage)
+		}
+	}
+	for _, c := range commands {
+		if c.name == name {
+			fs.Usage = func() {
+				fmt.Fprintf(os.Stderr, "usage: %s %s %s\n\n%s.\n\n",
+					os.Args[0], c.name, c.args, c.summary)
+				fs.PrintDefaults()
+			}
+		}
+	}
+	return fs
+}
+
+// usageError prints the usage of a subcommand and exits with status 2, as
+// the flag package does for bad flags.
+func usageError(fs *flag.FlagSet, format string, v ...interface{}) {
+	if format != "" {
+		fmt.Fprintf(os.Stderr, format+"\n", v...)
+	}
+	fs.Usage()
+	os.Exit(2)
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s <command> [flags] [args]\n\ncommands:\n", os.Args[0])
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-9s %s\n", c.name, c.summary)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s help <command>' for the flags of a command.\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Without a command, the flags and datadir are those of eval.\n")
+	fmt.Fprintf(os.Stderr, "Exit status is 0 on success, 1 on errors, and 2 on bad usage.\n")
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+	flag.Usage = usage
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	switch name := os.Args[1]; name {
+	case "help", "-h", "-help", "--help":
+		if len(os.Args) > 2 {
+			for _, c := range commands {
+				if c.name == os.Args[2] {
+					c.run([]string{"-h"})
+				}
+			}
+			fmt.Fprintf(os.Stderr, "unknown command %q\n", os.Args[2])
+			os.Exit(2)
+		}
+		usage()
+		return
+	default:
+		if strings.HasPrefix(name, "-") {
+			// flags without a command, as before subcommands
+			evalMain(os.Args[1:])
+			return
+		}
+		for _, c := range commands {
+			if c.name == name {
+				c.run(os.Args[2:])
+				return
+			}
+		}
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", name)
+		usage()
+		os.Exit(2)
+	}
+}
+
+// interruptContext is cancelled on the first SIGINT or SIGTERM, letting
+// go-knn finish in-flight work and write what it has. The signals are then
+// handled as usual, so a second interrupt exits immediately.
+func interruptContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-c
+		signal.Stop(c)
+		log.Printf("interrupted, finishing in-flight work (interrupt again to exit now)")
+		cancel()
+	}()
+	return ctx
+}
+
+// parseExperiment parses the flags of the train and eval subcommands.
+func parseExperiment(name string, args []string) {
+	fs := newFlagSet(name, "dataset", "attack", "wllcc", "stream", "split", "experiment")
+	fs.Parse(args)
+	if *sites == 0 || *instances == 0 {
+		usageError(fs, "missing sites and/or instances argument")
+	}
+	if fs.NArg() != 1 {
+		usageError(fs, "need to specify data dir")
+	}
+	if name != "eval" && *curve != "" {
+		usageError(fs, "a learning curve needs evaluation")
+	}
+	datadir = fs.Arg(0)
+}
+
+// trainMain is the train subcommand: learn the weights of all folds and
+// write the model without evaluating.
+func trainMain(args []string) {
+	parseExperiment("train", args)
+	ctx := interruptContext()
+	if experiment(ctx, false); ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
+
+// evalMain is the eval subcommand: the k-fold cross-validation of the attack.
+func evalMain(args []string) {
+	parseExperiment("eval", args)
+	ctx := interruptContext()
+	if *curve != "" {
+		learningCurve(ctx)
+	} else {
+		experiment(ctx, true)
+	}
+	if ctx.Err() != nil {
+		os.Exit(1)
+	}
+}
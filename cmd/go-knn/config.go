@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// experimentConfig is a declarative experiment: the flags of eval (by name)
+// for a dataset, and a matrix of flag values that expands into one run per
+// combination.
+type experimentConfig struct {
+	Name string `json:"name"`
+	// Output is the folder of the combined report, with a subfolder per run.
+	Output string `json:"output"`
+	// Data is the data dir, unless in the matrix as "data".
+	Data string `json:"data"`
+	// FeatureSet and Voting are checked against what go-knn supports.
+	FeatureSet string                   `json:"featureSet"`
+	Voting     string                   `json:"voting"`
+	Flags      map[string]interface{}   `json:"flags"`
+	Matrix     map[string][]interface{} `json:"matrix"`
+}
+
+// experimentRun is one run of an experiment: flag values, including the data
+// dir as "data", and the matrix values that define the run.
+type experimentRun struct {
+	name   string
+	flags  map[string]string
+	matrix []string // values in the order of the sorted matrix keys
+}
+
+func loadConfig(name string) (*experimentConfig, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	c := new(experimentConfig)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(c); err != nil {
+		return nil, fmt.Errorf("failed to parse experiment %s (%s)", name, err)
+	}
+	if c.FeatureSet != "" && c.FeatureSet != FeatureSet {
+		return nil, fmt.Errorf("unsupported feature set %q (supported: %s)", c.FeatureSet, FeatureSet)
+	}
+	if c.Voting != "" && c.Voting != VotingUnanimous {
+		return nil, fmt.Errorf("unsupported voting %q (supported: %s)", c.Voting, VotingUnanimous)
+	}
+	if c.Output == "" {
+		c.Output = strings.TrimSuffix(path.Base(name), path.Ext(name))
+	}
+	return c, nil
+}
+
+// configValue formats a JSON value as a flag value.
+func configValue(v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	}
+	return "", fmt.Errorf("unsupported value %v", v)
+}
+
+// matrixKeys are the sorted keys of the matrix, the last varying fastest.
+func (c *experimentConfig) matrixKeys() (keys []string) {
+	for k := range c.Matrix {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return
+}
+
+// runs expands the matrix of the experiment into runs.
+func (c *experimentConfig) runs() (runs []experimentRun, err error) {
+	base := map[string]string{"data": c.Data}
+	for name, v := range c.Flags {
+		if base[name], err = configValue(v); err != nil {
+			return nil, fmt.Errorf("flag %s: %s", name, err)
+		}
+	}
+
+	runs = []experimentRun{{flags: base}}
+	for _, key := range c.matrixKeys() {
+		if len(c.Matrix[key]) == 0 {
+			return nil, fmt.Errorf("no values for %s in matrix", key)
+		}
+		var expanded []experimentRun
+		for _, r := range runs {
+			for _, v := range c.Matrix[key] {
+				value, err := configValue(v)
+				if err != nil {
+					return nil, fmt.Errorf("matrix %s: %s", key, err)
+				}
+				flags := make(map[string]string)
+				for name, v := range r.flags {
+					flags[name] = v
+				}
+				flags[key] = value
+				expanded = append(expanded, experimentRun{
+					flags:  flags,
+					matrix: append(append([]string(nil), r.matrix...), value)})
+			}
+		}
+		runs = expanded
+	}
+
+	// name runs by their matrix values, such that they can be told apart
+	for i := range runs {
+		var parts []string
+		for j, key := range c.matrixKeys() {
+			v := runs[i].matrix[j]
+			if key == "data" {
+				v = path.Base(v)
+			}
+			parts = append(parts, key+"="+strings.NewReplacer("/", "_", " ", "_").Replace(v))
+		}
+		runs[i].name = strings.Join(parts, ",")
+		if runs[i].name == "" {
+			runs[i].name = "run"
+		}
+		if runs[i].flags["data"] == "" {
+			return nil, fmt.Errorf("no data dir for run %s", runs[i].name)
+		}
+	}
+	return
+}
+
+// apply sets the flags of the run, all of which have to be eval flags
+// (except out, set per run, and curve).
+func (r experimentRun) apply(output string) error {
+	allowed := make(map[string]bool)
+	for _, group := range []string{"dataset", "attack", "wllcc", "stream", "split", "experiment"} {
+		for _, name := range flagGroups[group] {
+			allowed[name] = name != "out" && name != "curve"
+		}
+	}
+	for name, value := range r.flags {
+		if name == "data" {
+			continue
+		}
+		if !allowed[name] {
+			return fmt.Errorf("unsupported flag %q", name)
+		}
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("bad value %q for flag %s (%s)", value, name, err)
+		}
+	}
+	datadir = r.flags["data"]
+	return flag.Set("out", path.Join(output, r.name))
+}
+
+// runMain is the run subcommand: run all experiments of a config file and
+// write a combined report.
+func runMain(args []string) {
+	fs := newFlagSet("run")
+	dry := fs.Bool("dry", false, "only list the runs of the experiment")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageError(fs, "need to specify an experiment file")
+	}
+	c, err := loadConfig(fs.Arg(0))
+	if err != nil {
+		log.Fatalf("failed to load experiment (%s)", err)
+	}
+	runs, err := c.runs()
+	if err != nil {
+		log.Fatalf("failed to expand experiment (%s)", err)
+	}
+	// check all runs before spending hours on the first
+	for _, r := range runs {
+		if err = r.apply(c.Output); err != nil {
+			log.Fatalf("run %s: %s", r.name, err)
+		}
+		if *sites == 0 || *instances == 0 {
+			log.Fatalf("run %s: missing sites and/or instances", r.name)
+		}
+		if *dry {
+			fmt.Printf("%s: data %s\n", r.name, datadir)
+		}
+	}
+	if *dry {
+		return
+	}
+
+	if err = os.MkdirAll(c.Output, 0777); err != nil {
+		log.Fatalf("failed to create output folder (%s)", err)
+	}
+	keys := c.matrixKeys()
+	report := bytes.NewBufferString("run")
+	for _, key := range keys {
+		str2buf(","+key, report)
+	}
+	str2buf(",work,attack,recall,precision,f1score,fpr,accuracy\n", report)
+	ctx := interruptContext()
+	for i, r := range runs {
+		log.Printf("experiment %s: run %d/%d (%s)", c.Name, i+1, len(runs), r.name)
+		r.apply(c.Output)
+		results, subfold := experiment(ctx, true)
+
+		for sub := 0; sub < len(subfold); sub++ {
+			var attacks []string
+			for attack := range results[sub] {
+				attacks = append(attacks, attack)
+			}
+			sort.Strings(attacks)
+			for _, attack := range attacks {
+				m := results[sub][attack]
+				str2buf(csvField(r.name), report)
+				for _, v := range r.matrix {
+					str2buf(","+csvField(v), report)
+				}
+				str2buf(fmt.Sprintf(",%s,%s,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+					csvField(subfold[sub]), attack,
+					recall(m), precision(m), f1score(m), fpr(m), accuracy(m)), report)
+			}
+		}
+		if ctx.Err() != nil {
+			writeFile(report.String(), path.Join(c.Output, "report-incomplete.csv"))
+			log.Fatalf("experiment %s: interrupted in run %d/%d, wrote incomplete report",
+				c.Name, i+1, len(runs))
+		}
+		// written after each run to keep the results of completed runs
+		writeFile(report.String(), path.Join(c.Output, "report.csv"))
+	}
+	log.Printf("experiment %s: wrote report of %d runs to %s", c.Name, len(runs),
+		path.Join(c.Output, "report.csv"))
+}
+
+// csvField quotes a CSV field if needed.
+func csvField(s string) string {
+	if strings.ContainsAny(s, ",\"\n") {
+		return "\"" + strings.Replace(s, "\"", "\"\"", -1) + "\""
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// extractMain is the extract subcommand: extract the features of all cell
+// traces in a folder, as cmd/feat.fixed but for go-knn's file names.
+func extractMain(args []string) {
+	fs := newFlagSet("extract")
+	out := fs.String("out", "", "the folder to write feature files to (default: the trace folder)")
+	suffix := fs.String("suffix", FeatureSuffix, "the suffix of the written feature files")
+	workers := fs.Int("f", 1, "the factor to multiply NumCPU with for creating workers")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageError(fs, "need to specify trace folder")
+	}
+	folder := fs.Arg(0)
+	if *out == "" {
+		*out = folder
+	}
+	if err := os.MkdirAll(*out, 0777); err != nil {
+		log.Fatalf("failed to create output folder (%s)", err)
+	}
+
+	dir, err := ioutil.ReadDir(folder)
+	if err != nil {
+		log.Fatalf("failed to read trace folder (%s)", err)
+	}
+	var failed int
+	var mutex sync.Mutex
+	wg := new(sync.WaitGroup)
+	work := make(chan string)
+	for i := 0; i < runtime.NumCPU()**workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range work {
+				times, sizes, err := readTrace(path.Join(folder, name))
+				if err == nil {
+					var features string
+					if len(times) == 0 {
+						err = fmt.Errorf("empty trace")
+					} else if features, err = extract(times, sizes); err == nil {
+						err = ioutil.WriteFile(path.Join(*out, name+*suffix),
+							[]byte(features+FeatureDelimiter), 0666)
+					}
+				}
+				if err != nil {
+					log.Printf("failed to extract features of %s (%s)", name, err)
+					mutex.Lock()
+					failed++
+					mutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	log.Printf("starting parsing...")
+	count := 0
+	for _, f := range dir {
+		// cell traces have no file extension
+		if f.IsDir() || strings.Contains(f.Name(), ".") {
+			continue
+		}
+		work <- f.Name()
+		count++
+	}
+	close(work)
+	wg.Wait()
+
+	log.Printf("done parsing (%d traces, folder \"%s\", output \"%s\", suffix \"%s\")",
+		count-failed, folder, *out, *suffix)
+	if failed > 0 {
+		log.Fatalf("failed to extract features of %d traces", failed)
+	}
+}
+
+// convertMain is the convert subcommand: copy a dataset in the layout of
+// Wang et al. (monitored "<site>-<instance><suffix>" and unmonitored
+// "<n><suffix>", numbered from 0) to go-knn's layout, where monitored sites
+// are numbered from roffset+1 and each unmonitored instance is its own site
+// after the monitored ones. Alternatively, it describes the dataset in a
+// manifest without copying.
+func convertMain(args []string) {
+	fs := newFlagSet("convert", "dataset")
+	suffix := fs.String("suffix", "",
+		"the suffix of the files to convert (e.g., \"s\" for features from cmd/feat.fixed)")
+	manifestOut := fs.String("manifest-out", "",
+		"write a manifest of the source folder to this file instead of copying (use with -manifest)")
+	fs.Parse(args)
+	if *sites == 0 || *instances == 0 {
+		usageError(fs, "missing sites and/or instances argument")
+	}
+	if *manifestOut != "" {
+		if fs.NArg() != 1 {
+			usageError(fs, "need to specify source folder")
+		}
+		var entries []manifestEntry
+		for site := 0; site < *sites; site++ {
+			for instance := 0; instance < *instances; instance++ {
+				entries = append(entries, manifestEntry{
+					Path:      strconv.Itoa(site) + "-" + strconv.Itoa(instance) + *suffix,
+					Site:      strconv.Itoa(site),
+					Instance:  strconv.Itoa(instance),
+					Monitored: true,
+				})
+			}
+		}
+		for n := 0; n < *open; n++ {
+			entries = append(entries, manifestEntry{
+				Path: strconv.Itoa(n) + *suffix,
+				Site: strconv.Itoa(*sites + n),
+			})
+		}
+		for _, e := range entries {
+			if _, err := os.Stat(path.Join(fs.Arg(0), e.Path)); err != nil {
+				log.Fatalf("failed to find instance (%s)", err)
+			}
+		}
+		if err := writeManifest(entries, *manifestOut); err != nil {
+			log.Fatalf("failed to write manifest (%s)", err)
+		}
+		log.Printf("wrote manifest of %d monitored and %d unmonitored instances in %s to %s",
+			*sites**instances, *open, fs.Arg(0), *manifestOut)
+		return
+	}
+	if fs.NArg() != 2 {
+		usageError(fs, "need to specify source and destination folders")
+	}
+	src, dst := fs.Arg(0), fs.Arg(1)
+	if err := os.MkdirAll(dst, 0777); err != nil {
+		log.Fatalf("failed to create destination folder (%s)", err)
+	}
+
+	// feature files get go-knn's feature suffix, traces stay without one
+	outSuffix := ""
+	if *suffix != "" {
+		outSuffix = FeatureSuffix
+	}
+	convert := func(from, to string) {
+		data, err := ioutil.ReadFile(path.Join(src, from))
+		if err != nil {
+			log.Fatalf("failed to read %s (%s)", from, err)
+		}
+		if err = ioutil.WriteFile(path.Join(dst, to+outSuffix), data, 0666); err != nil {
+			log.Fatalf("failed to write %s (%s)", to, err)
+		}
+	}
+
+	for site := 0; site < *sites; site++ {
+		for instance := 0; instance < *instances; instance++ {
+			convert(strconv.Itoa(site)+"-"+strconv.Itoa(instance)+*suffix,
+				strconv.Itoa(*roffset+site+1)+"-"+strconv.Itoa(instance))
+		}
+	}
+	for n := 0; n < *open; n++ {
+		convert(strconv.Itoa(n)+*suffix,
+			strconv.Itoa(*roffset+*sites+n+1)+"-0")
+	}
+	log.Printf("converted %d monitored and %d unmonitored instances from %s to %s",
+		*sites**instances, *open, src, dst)
+}
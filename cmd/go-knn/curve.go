@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"path"
+	"sort"
+	"strconv"
+)
+
+// limitTraining keeps n training instances of each monitored site in every
+// fold of a split of count instances, drawn at random from its training
+// fold. Smaller n keep a subset of the instances of larger n.
+func limitTraining(s Splitter, n, count int, seed int64) (Splitter, error) {
+	rng := rand.New(rand.NewSource(seed))
+	limited := newTableSplit(s.Name(), s.Folds(), count)
+	limited.trainOnly()
+	for f := 0; f < s.Folds(); f++ {
+		for i := 0; i < count; i++ {
+			limited.testing[f][i] = s.Testing(i, f)
+			// all of the open world is kept
+			limited.training[f][i] = i >= *sites**instances && s.Training(i, f)
+		}
+		for site := 0; site < *sites; site++ {
+			var training []int
+			for i := site * *instances; i < (site+1)**instances; i++ {
+				if s.Training(i, f) {
+					training = append(training, i)
+				}
+			}
+			if len(training) < n {
+				return nil, fmt.Errorf("fold %d has %d training instances of site %d, less than %d",
+					f, len(training), site, n)
+			}
+			for _, p := range rng.Perm(len(training))[:n] {
+				limited.training[f][training[p]] = true
+			}
+		}
+	}
+	return limited, nil
+}
+
+// learningCurve evaluates the attack with each number of training instances
+// per monitored site in -curve, writing the run of each size to a subfolder
+// and a table of the metrics by size.
+func learningCurve(ctx context.Context) {
+	sizes, err := parseSizes(*curve)
+	if err != nil || len(sizes) == 0 {
+		log.Fatalf("bad learning curve %q", *curve)
+	}
+	base := *outDir
+	out := bytes.NewBufferString("work,attack,train-instances,recall,precision,f1score,fpr,accuracy\n")
+	for i, n := range sizes {
+		if n < 1 {
+			log.Fatalf("need at least one training instance per site")
+		}
+		if err := curveReco(n); err != nil {
+			log.Printf("warning: skipping %d training instances per site (%s)", n, err)
+			continue
+		}
+		log.Printf("learning curve: %d/%d (%d training instances per site)", i+1, len(sizes), n)
+		flag.Set("train-instances", strconv.Itoa(n))
+		flag.Set("out", path.Join(base, "train-instances="+strconv.Itoa(n)))
+		results, subfold := experiment(ctx, true)
+
+		for sub := 0; sub < len(subfold); sub++ {
+			var attacks []string
+			for attack := range results[sub] {
+				attacks = append(attacks, attack)
+			}
+			sort.Strings(attacks)
+			for _, attack := range attacks {
+				m := results[sub][attack]
+				str2buf(fmt.Sprintf("%s,%s,%d,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+					csvField(subfold[sub]), attack, n,
+					recall(m), precision(m), f1score(m), fpr(m), accuracy(m)), out)
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+
+	flag.Set("out", base)
+	if ctx.Err() != nil {
+		writeFile(out.String(), outputName("-curve-incomplete.csv"))
+		return
+	}
+	writeFile(out.String(), outputName("-curve.csv"))
+}
+
+// curveReco checks that WLLCC has more training instances per site than good
+// neighbours (given or tuned by the flags) when keeping n per site.
+func curveReco(n int) error {
+	m, err := parseMetrics(*metricList)
+	if err != nil {
+		return nil // reported by the experiment
+	}
+	if !anyWeighted(m) {
+		return nil
+	}
+	reco, training := *recoPoints, n
+	if *tune != "" {
+		recos, err := parseIntList(*tuneReco)
+		if err != nil || len(recos) == 0 {
+			return nil // reported by the experiment
+		}
+		_, reco = spanInt(recos)
+		training = innerTraining(n)
+	}
+	if reco >= training {
+		return fmt.Errorf("%d good neighbours need more than %d training instances per site",
+			reco, training)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// dedupMain is the dedup subcommand: find the instances of a dataset folder
+// with identical traces or features, or features within a distance of each
+// other, and optionally write a manifest without them.
+func dedupMain(args []string) {
+	fs := newFlagSet("dedup", "dataset")
+	threshold := fs.Float64("threshold", 0,
+		"also group instances with features within this distance (0 for exact duplicates only)")
+	metric := fs.String("metric", "l1", "the metric of the distance")
+	modelName := fs.String("model", "",
+		"model to take the weights and normalization of the distance from (default: unit weights)")
+	fold := fs.Int("fold", 0, "the fold in the model to take the weights of")
+	workers := fs.Int("f", 1, "the factor to multiply NumCPU with for creating workers")
+	reportFile := fs.String("report", "", "file to write the duplicates to (JSON)")
+	manifestOut := fs.String("manifest-out", "",
+		"write a manifest of the dataset without the duplicates to this file")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageError(fs, "need to specify data dir")
+	}
+	root := fs.Arg(0)
+	m, err := getMetric(*metric)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	var mf *modelFile
+	if *modelName != "" {
+		if mf, err = loadModel(*modelName); err != nil {
+			log.Fatalf("failed to load model (%s)", err)
+		}
+	}
+	if *manifestOut != "" && *manifestFile == "" && *sites == 0 {
+		log.Fatalf("need -sites to tell monitored sites apart in the manifest")
+	}
+
+	var groups []duplicateGroup
+	var skipped []skippedFile
+	var kept []manifestEntry
+	for _, work := range datasetWorks(root) {
+		dir, files := workFeatureFiles(root, work)
+		weight, s := unitWeights(), (*scaler)(nil)
+		if mf != nil {
+			if weight, s, err = modelWeights(mf, work, *fold, *metric); err != nil {
+				log.Fatalf("failed to use model for work %q (%s)", work, err)
+			}
+		}
+		files, feat, traces, bad := readInstances(dir, files)
+		found := findDuplicates(files, feat, traces, *threshold, m, weight, s,
+			runtime.NumCPU()**workers)
+		exact, across := 0, 0
+		for _, g := range found {
+			if g.Exact {
+				exact++
+			}
+			if len(g.Sites) > 1 {
+				across++
+			}
+		}
+		name := work
+		if name == "" {
+			name = "."
+		}
+		fmt.Printf("work %s: %d instances, %d groups of duplicates (%d exact, %d across sites)\n",
+			name, len(files), len(found), exact, across)
+		for _, b := range bad {
+			fmt.Printf("\tskipped %s (%s)\n", b.File, b.Problem)
+			skipped = append(skipped, skippedFile{work, b.File, b.Problem})
+		}
+		for _, g := range found {
+			how := "exact"
+			if !g.Exact {
+				how = "within " + strconv.FormatFloat(g.Distance, 'g', 4, 64)
+			}
+			fmt.Printf("\t%s (sites %s, %s)\n", strings.Join(g.Files, " "),
+				strings.Join(g.Sites, " "), how)
+		}
+		for i := range found {
+			found[i].Work = work
+		}
+		groups = append(groups, found...)
+		if *manifestOut != "" {
+			kept = append(kept, withoutDuplicates(work, files, found)...)
+		}
+	}
+
+	if *reportFile != "" {
+		r := dedupReport{Groups: groups, Skipped: skipped}
+		if r.Groups == nil {
+			r.Groups = []duplicateGroup{}
+		}
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			log.Fatalf("failed to encode report (%s)", err)
+		}
+		writeFile(string(data)+"\n", *reportFile)
+	}
+	if *manifestOut != "" {
+		if err := writeManifest(kept, *manifestOut); err != nil {
+			log.Fatalf("failed to write manifest (%s)", err)
+		}
+		log.Printf("wrote manifest of %d instances to %s", len(kept), *manifestOut)
+	}
+	if len(skipped) > 0 {
+		log.Printf("skipped %d files that could not be read", len(skipped))
+		os.Exit(1)
+	}
+}
+
+// dedupReport is what dedup finds in a dataset folder.
+type dedupReport struct {
+	Groups []duplicateGroup `json:"groups"`
+	// Skipped are the files that could not be read, not in the manifest.
+	Skipped []skippedFile `json:"skipped,omitempty"`
+}
+
+type skippedFile struct {
+	Work    string `json:"work"`
+	File    string `json:"file"`
+	Problem string `json:"problem"`
+}
+
+// duplicateGroup are instances of a work that are duplicates of each other.
+type duplicateGroup struct {
+	Work  string   `json:"work"`
+	Files []string `json:"files"`
+	Sites []string `json:"sites"`
+	// Exact is true if the instances have identical traces or features,
+	// otherwise some are only within the threshold of another.
+	Exact bool `json:"exact"`
+	// Distance is the largest distance that joined the group, 0 if exact.
+	Distance float64 `json:"distance"`
+}
+
+// workFeatureFiles are the feature files of a work, relative to the returned
+// dir: those in the manifest or those in the work's folder.
+func workFeatureFiles(root, work string) (dir string, files []string) {
+	if manifest != nil {
+		for _, e := range manifest.Entries {
+			if e.Work == work {
+				files = append(files, e.Path)
+			}
+		}
+		return root, files
+	}
+	dir = path.Join(root, work)
+	list, err := ioutil.ReadDir(dir)
+	if err != nil {
+		log.Fatalf("failed to read work %s (%s)", dir, err)
+	}
+	for _, f := range list {
+		if !f.IsDir() && strings.HasSuffix(f.Name(), FeatureSuffix) {
+			files = append(files, f.Name())
+		}
+	}
+	return
+}
+
+// modelWeights are the weights and normalization of a metric in a fold of
+// the model for a work.
+func modelWeights(mf *modelFile, work string, fold int, metric string) ([]float64, *scaler, error) {
+	w, err := mf.work(work)
+	if err != nil {
+		return nil, nil, err
+	}
+	f, err := w.fold(fold)
+	if err != nil {
+		return nil, nil, err
+	}
+	weight, err := f.weights(metric)
+	if err != nil {
+		return nil, nil, err
+	}
+	return weight, f.scaler(), nil
+}
+
+// readInstances reads the features of the instances in files and their cell
+// traces next to them, if any, skipping the files that cannot be read or do
+// not have the expected features.
+func readInstances(dir string, files []string) (read []string, feat [][]float64, traces [][]byte,
+	skipped []fileProblem) {
+	for _, f := range files {
+		features, err := readFeatureFile(path.Join(dir, f))
+		if err == nil && len(features) != FeatNum {
+			err = fmt.Errorf("%d features, expected %d", len(features), FeatNum)
+		}
+		trace, traceErr := ioutil.ReadFile(traceFile(dir, f))
+		if os.IsNotExist(traceErr) {
+			trace, traceErr = nil, nil
+		}
+		if err == nil {
+			err = traceErr
+		}
+		if err != nil {
+			skipped = append(skipped, fileProblem{f, err.Error()})
+			continue
+		}
+		read = append(read, f)
+		feat = append(feat, features)
+		traces = append(traces, trace)
+	}
+	return
+}
+
+// findDuplicates groups the instances in files with identical cell traces or
+// features, and, if threshold is positive, those with features within
+// threshold of each other under the metric.
+func findDuplicates(files []string, feat [][]float64, traces [][]byte, threshold float64,
+	m Metric, weight []float64, s *scaler, workers int) []duplicateGroup {
+	parent := make([]int, len(files))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(i int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+	// distance maps the roots of groups joined by a distance to the largest
+	distance := make(map[int]float64)
+	union := func(i, j int, d float64, exact bool) {
+		a, b := find(i), find(j)
+		if a == b {
+			return
+		}
+		if a > b {
+			a, b = b, a
+		}
+		parent[b] = a
+		if dist, joined := distance[b]; joined {
+			delete(distance, b)
+			distance[a] = math.Max(distance[a], dist)
+		}
+		if !exact {
+			distance[a] = math.Max(distance[a], d)
+		}
+	}
+
+	// exact duplicates by hash
+	seen := make(map[[sha256.Size]byte]int)
+	same := func(hash [sha256.Size]byte, i int) {
+		if j, exists := seen[hash]; exists {
+			union(j, i, 0, true)
+		} else {
+			seen[hash] = i
+		}
+	}
+	for i := range files {
+		buf := make([]byte, 8*FeatNum+1)
+		buf[0] = 'f' // features and traces never collide
+		for k, v := range feat[i] {
+			binary.LittleEndian.PutUint64(buf[1+8*k:], math.Float64bits(v))
+		}
+		same(sha256.Sum256(buf), i)
+		if len(strings.TrimSpace(string(traces[i]))) > 0 {
+			same(sha256.Sum256(append([]byte{'t'}, traces[i]...)), i)
+		}
+	}
+
+	if threshold > 0 {
+		if s != nil {
+			feat = s.transformAll(feat)
+		}
+		near := nearPairs(feat, threshold, m, weight, workers)
+		for _, p := range near {
+			union(p.i, p.j, p.d, false)
+		}
+	}
+
+	members := make(map[int][]int)
+	for i := range files {
+		members[find(i)] = append(members[find(i)], i)
+	}
+	var groups []duplicateGroup
+	for root, group := range members {
+		if len(group) < 2 {
+			continue
+		}
+		g := duplicateGroup{Distance: distance[root]}
+		_, joined := distance[root]
+		g.Exact = !joined
+		sites := make(map[string]bool)
+		for _, i := range group {
+			g.Files = append(g.Files, files[i])
+			if site := siteOf(files[i]); !sites[site] {
+				sites[site] = true
+				g.Sites = append(g.Sites, site)
+			}
+		}
+		sort.Slice(g.Sites, func(i, j int) bool { return labelLess(g.Sites[i], g.Sites[j]) })
+		groups = append(groups, g)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Files[0] < groups[j].Files[0] })
+	return groups
+}
+
+type pair struct {
+	i, j int
+	d    float64
+}
+
+// nearPairs are the pairs of instances within threshold of each other,
+// compared in parallel.
+func nearPairs(feat [][]float64, threshold float64, m Metric, weight []float64,
+	workers int) (pairs []pair) {
+	var mutex sync.Mutex
+	wg := new(sync.WaitGroup)
+	work := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var found []pair
+			for i := range work {
+				presentFeat := make([]int, 0, FeatNum)
+				for k := 0; k < FeatNum; k++ {
+					if feat[i][k] != -1 {
+						presentFeat = append(presentFeat, k)
+					}
+				}
+				for j := i + 1; j < len(feat); j++ {
+					if d := m.Dist(feat[i], feat[j], weight, presentFeat); d <= threshold {
+						found = append(found, pair{i, j, d})
+					}
+				}
+			}
+			mutex.Lock()
+			pairs = append(pairs, found...)
+			mutex.Unlock()
+		}()
+	}
+	for i := range feat {
+		work <- i
+	}
+	close(work)
+	wg.Wait()
+	// union in a fixed order, for the same groups every run
+	sort.Slice(pairs, func(a, b int) bool {
+		if pairs[a].i == pairs[b].i {
+			return pairs[a].j < pairs[b].j
+		}
+		return pairs[a].i < pairs[b].i
+	})
+	return
+}
+
+// withoutDuplicates are the manifest entries of the instances of a work that
+// are not duplicates: the first of each group of one site is kept, while
+// groups across sites (e.g., identical error pages) are dropped entirely.
+func withoutDuplicates(work string, files []string, groups []duplicateGroup) (entries []manifestEntry) {
+	drop := make(map[string]bool)
+	for _, g := range groups {
+		from := 1
+		if len(g.Sites) > 1 {
+			from = 0
+		}
+		for _, f := range g.Files[from:] {
+			drop[f] = true
+		}
+	}
+	for _, f := range files {
+		if drop[f] {
+			continue
+		}
+		if manifest != nil {
+			entries = append(entries, *manifest.byPath[path.Clean(f)])
+			continue
+		}
+		// go-knn's file names: site-instance.feat, monitored after roffset
+		name := strings.TrimSuffix(f, FeatureSuffix)
+		e := manifestEntry{Path: path.Join(work, f), Work: work, Site: siteOf(f)}
+		if index := strings.Index(name, "-"); index != -1 {
+			e.Instance = name[index+1:]
+		}
+		site, err := strconv.Atoi(e.Site)
+		e.Monitored = err == nil && site > *roffset && site <= *roffset+*sites
+		entries = append(entries, e)
+	}
+	return
+}
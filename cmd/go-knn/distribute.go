@@ -0,0 +1,529 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// pollInterval is how often idle workers ask the coordinator for units.
+const pollInterval = time.Second
+
+// unit is a range of instances of a fold, of which workers test those in the
+// testing fold.
+type unit struct {
+	ID   int    `json:"id"`
+	Job  string `json:"job"`
+	Fold int    `json:"fold"`
+	From int    `json:"from"`
+	To   int    `json:"to"`
+}
+
+// job is what workers need to test the units of a work: the model of the
+// work and the flags of the attack.
+type job struct {
+	Key string `json:"key"`
+	// Subdir is the folder of the work in the data dir, empty for the data dir.
+	Subdir string            `json:"subdir"`
+	Model  *modelFile        `json:"model"`
+	Flags  map[string]string `json:"flags"`
+	// Manifest are the manifest entries of the instances of the work, nil
+	// without a manifest.
+	Manifest []manifestEntry `json:"manifest,omitempty"`
+}
+
+// unitResult are the metrics of the attacks on the instances of a unit.
+type unitResult struct {
+	ID      int               `json:"id"`
+	Job     string            `json:"job"`
+	Worker  string            `json:"worker"`
+	Results map[string][5]int `json:"results"`
+}
+
+// coordinator hands out units of test instances to workers over HTTP and
+// collects their metrics. Units not returned within the lease are handed out
+// again, so lost workers only delay the evaluation.
+type coordinator struct {
+	lease time.Duration
+
+	mu       sync.Mutex
+	job      *job
+	units    []unit
+	leases   map[int]time.Time // unit -> lease deadline
+	owners   map[int]string    // unit -> worker
+	results  map[int]map[string]metrics
+	finished bool
+	progress chan struct{}
+}
+
+func newCoordinator(addr string, lease time.Duration) (*coordinator, error) {
+	c := &coordinator{lease: lease, progress: make(chan struct{}, 1)}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/unit", c.handleUnit)
+	mux.HandleFunc("/job", c.handleJob)
+	mux.HandleFunc("/result", c.handleResult)
+	go func() {
+		log.Fatal(http.Serve(l, mux))
+	}()
+	log.Printf("coordinating workers on %s", l.Addr())
+	return c, nil
+}
+
+func (c *coordinator) handleUnit(w http.ResponseWriter, r *http.Request) {
+	worker := r.URL.Query().Get("worker")
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.finished {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+	now := time.Now()
+	for _, u := range c.units {
+		if _, done := c.results[u.ID]; done {
+			continue
+		}
+		deadline, leased := c.leases[u.ID]
+		if leased && now.Before(deadline) {
+			continue
+		}
+		if leased {
+			log.Printf("\treassigning unit %d from worker %s to %s", u.ID, c.owners[u.ID], worker)
+		}
+		c.leases[u.ID], c.owners[u.ID] = now.Add(c.lease), worker
+		writeJSON(w, http.StatusOK, u)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (c *coordinator) handleJob(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.job == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJSON(w, http.StatusOK, c.job)
+}
+
+func (c *coordinator) handleResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var res unitResult
+	if err := json.NewDecoder(r.Body).Decode(&res); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("bad request (%s)", err))
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// results of earlier jobs and of reassigned units done twice are dropped
+	_, done := c.results[res.ID]
+	if c.job != nil && res.Job == c.job.Key && res.ID >= 0 && res.ID < len(c.units) && !done {
+		c.results[res.ID] = fromCounts(res.Results)
+		select {
+		case c.progress <- struct{}{}:
+		default:
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// evaluate tests all instances of a work with workers, except for the folds
+// to skip, until done or ctx is cancelled. It returns the results of each
+// fold and whether all its units were tested.
+func (c *coordinator) evaluate(ctx context.Context, j *job, skip []bool,
+	unitSize int) (foldResults []map[string]metrics, complete []bool) {
+	c.mu.Lock()
+	c.job, c.units = j, nil
+	c.leases, c.owners = make(map[int]time.Time), make(map[int]string)
+	c.results = make(map[int]map[string]metrics)
+	total := j.Model.Sites*j.Model.Instances + j.Model.Open
+	for fold := 0; fold < j.Model.Folds; fold++ {
+		if skip[fold] {
+			continue
+		}
+		for from := 0; from < total; from += unitSize {
+			to := from + unitSize
+			if to > total {
+				to = total
+			}
+			c.units = append(c.units, unit{ID: len(c.units), Job: j.Key, Fold: fold,
+				From: from, To: to})
+		}
+	}
+	c.mu.Unlock()
+	log.Printf("\thanding out %d units to workers", len(c.units))
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		c.mu.Lock()
+		done := len(c.results)
+		c.mu.Unlock()
+		if !*quiet {
+			fmt.Printf("\r\t\t\t\ttested %d/%d units", done, len(c.units))
+		}
+		if done == len(c.units) || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-c.progress:
+		case <-ticker.C:
+		case <-ctx.Done():
+		}
+	}
+	if !*quiet {
+		fmt.Println("")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	foldResults = make([]map[string]metrics, j.Model.Folds)
+	complete = make([]bool, j.Model.Folds)
+	for fold := 0; fold < j.Model.Folds; fold++ {
+		foldResults[fold] = make(map[string]metrics)
+		complete[fold] = !skip[fold]
+	}
+	for _, u := range c.units {
+		res, done := c.results[u.ID]
+		if !done {
+			complete[u.Fold] = false
+			continue
+		}
+		for attack, m := range res {
+			sum := foldResults[u.Fold][attack]
+			addResult(&sum, &m)
+			foldResults[u.Fold][attack] = sum
+		}
+	}
+	c.job, c.units = nil, nil
+	return
+}
+
+// finish tells workers that there are no more units, giving polling workers
+// time to hear it.
+func (c *coordinator) finish() {
+	c.mu.Lock()
+	c.finished = true
+	c.mu.Unlock()
+	time.Sleep(2 * pollInterval)
+}
+
+// newJob creates the job for a work, of which the model is the learned
+// weights of all folds.
+func newJob(model *modelFile, wm workModel, subdir string) *job {
+	mf := *model
+	mf.Works = []workModel{wm}
+	j := &job{
+		Key:    strconv.FormatInt(time.Now().UnixNano(), 36) + "-" + wm.Name,
+		Subdir: subdir,
+		Model:  &mf,
+		Flags:  make(map[string]string),
+	}
+	names := append([]string{"open-instances", "sweep-open", "sweep-open-test"}, flagGroups["stream"]...)
+	for _, name := range names {
+		if name != "traces" {
+			j.Flags[name] = flag.Lookup(name).Value.String()
+		}
+	}
+	if manifest != nil {
+		for _, ref := range wm.Instances {
+			if e, exists := manifest.byPath[path.Clean(ref.File)]; exists {
+				j.Manifest = append(j.Manifest, *e)
+			}
+		}
+	}
+	return j
+}
+
+// workerJob is a job set up on a worker.
+type workerJob struct {
+	*job
+	feat, openfeat [][]float64
+	files          []string
+	tracedir       string
+	folds          map[int]*workerFold
+}
+
+// workerFold is a fold of a job, normalized with its weights.
+type workerFold struct {
+	scaler         *scaler
+	weights        [][]float64
+	feat, openfeat [][]float64
+}
+
+// setup sets the flags of the job and reads the instances of its work from
+// the data dir.
+func (j *workerJob) setup(data, traces string) error {
+	mf := j.Model
+	if len(mf.Works) != 1 || len(mf.Works[0].Folds) == 0 {
+		return fmt.Errorf("job without a work")
+	}
+	work := &mf.Works[0]
+	var metricNames []string
+	for _, m := range work.Folds[0].Metrics {
+		metricNames = append(metricNames, m.Metric)
+	}
+	values := map[string]string{
+		"sites":     strconv.Itoa(mf.Sites),
+		"instances": strconv.Itoa(mf.Instances),
+		"open":      strconv.Itoa(mf.Open),
+		"roffset":   strconv.Itoa(mf.ROffset),
+		"folds":     strconv.Itoa(mf.Folds),
+		"wKmin":     strconv.Itoa(mf.KMin),
+		"wKmax":     strconv.Itoa(mf.KMax),
+		"wKstep":    strconv.Itoa(mf.KStep),
+		"metric":    strings.Join(metricNames, ","),
+	}
+	for name, value := range j.Flags {
+		values[name] = value
+	}
+	for name, value := range values {
+		if err := flag.Set(name, value); err != nil {
+			return fmt.Errorf("bad value %q for flag %s (%s)", value, name, err)
+		}
+	}
+	var err error
+	if distMetrics, err = parseMetrics(*metricList); err != nil {
+		return err
+	}
+	manifest = nil
+	if j.Manifest != nil {
+		manifest = &datasetManifest{Entries: j.Manifest}
+		if err = manifest.index("of job " + j.Key); err != nil {
+			return err
+		}
+	}
+	if split, err = modelSplit(work); err != nil {
+		return err
+	}
+	if prefixSpecs, err = parsePrefixSpecs(*prefixList); err != nil {
+		return err
+	}
+	if err = parseSweep(); err != nil {
+		return err
+	}
+
+	workdir := path.Join(data, j.Subdir)
+	j.tracedir = workdir
+	if traces != "" {
+		j.tracedir = path.Join(traces, j.Subdir)
+	}
+	if len(work.Instances) != mf.Sites*mf.Instances+mf.Open {
+		return fmt.Errorf("work %s has %d instances, expected %d", work.Name,
+			len(work.Instances), mf.Sites*mf.Instances+mf.Open)
+	}
+	for i, ref := range work.Instances {
+		if ref.Class != classOf(i) {
+			return fmt.Errorf("instance %s has class %d, expected %d", ref.File, ref.Class, classOf(i))
+		}
+		f, err := readFeatureFile(path.Join(workdir, ref.File))
+		if err != nil {
+			return err
+		}
+		if len(f) != FeatNum {
+			return fmt.Errorf("%s has %d features, expected %d", ref.File, len(f), FeatNum)
+		}
+		if i < mf.Sites*mf.Instances {
+			j.feat = append(j.feat, f)
+		} else {
+			j.openfeat = append(j.openfeat, f)
+		}
+		j.files = append(j.files, ref.File)
+	}
+	setOpenSites(j.files, j.files)
+	j.folds = make(map[int]*workerFold)
+	return nil
+}
+
+// fold sets up a fold of the job.
+func (j *workerJob) fold(n int) (*workerFold, error) {
+	if f, exists := j.folds[n]; exists {
+		return f, nil
+	}
+	fm, err := j.Model.Works[0].fold(n)
+	if err != nil {
+		return nil, err
+	}
+	f := &workerFold{scaler: fm.scaler()}
+	for m := 0; m < len(distMetrics); m++ {
+		w, err := fm.weights(distMetrics[m].Name())
+		if err != nil {
+			return nil, err
+		}
+		f.weights = append(f.weights, w)
+	}
+	f.feat, f.openfeat = j.feat, j.openfeat
+	if f.scaler.Method != "none" {
+		f.feat, f.openfeat = f.scaler.transformAll(j.feat), f.scaler.transformAll(j.openfeat)
+	}
+	j.folds[n] = f
+	return f, nil
+}
+
+// test tests the instances of a unit in parallel.
+func (j *workerJob) test(u unit, workers int) (map[string]metrics, error) {
+	f, err := j.fold(u.Fold)
+	if err != nil {
+		return nil, err
+	}
+	results := make(map[string]metrics)
+	var mutex sync.Mutex
+	in := make(chan int)
+	wg := new(sync.WaitGroup)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range in {
+				var prefixes []prefix
+				if streaming() || len(prefixSpecs) > 0 {
+					prefixes = readPrefixes(traceFile(j.tracedir, j.files[i]), f.scaler)
+				}
+				res := test(i, features(i, f.feat, f.openfeat), prefixes, u.Fold, f.weights,
+					f.feat, f.openfeat)
+				mutex.Lock()
+				for attack, m := range res {
+					sum := results[attack]
+					addResult(&sum, &m)
+					results[attack] = sum
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+	for i := u.From; i < u.To && i < len(j.files); i++ {
+		if instanceForTesting(i, u.Fold) {
+			in <- i
+		}
+	}
+	close(in)
+	wg.Wait()
+	return results, nil
+}
+
+// workerMain is the worker subcommand: test units handed out by a
+// coordinator (eval -coordinate) on a local copy of the dataset.
+func workerMain(args []string) {
+	fs := newFlagSet("worker")
+	coord := fs.String("coordinator", "", "the URL of the coordinator, e.g., http://host:7070")
+	data := fs.String("data", "", "the local data dir, as given to the coordinator")
+	traces := fs.String("traces", "", "the local folder with cell traces (default: the data dir)")
+	workerFactor := fs.Int("f", 1, "the factor to multiply NumCPU with for creating workers")
+	hostname, _ := os.Hostname()
+	name := fs.String("name", hostname+"-"+strconv.Itoa(os.Getpid()), "the name of the worker")
+	wait := fs.Duration("wait", time.Minute, "how long to wait for an unreachable coordinator")
+	fs.Parse(args)
+	if *coord == "" || *data == "" || fs.NArg() != 0 {
+		usageError(fs, "need a coordinator and a data dir")
+	}
+	base := strings.TrimSuffix(*coord, "/")
+	if !strings.Contains(base, "://") {
+		base = "http://" + base
+	}
+
+	var current *workerJob
+	lastContact, tested := time.Now(), 0
+	for {
+		resp, err := http.Get(base + "/unit?worker=" + *name)
+		if err != nil {
+			if time.Since(lastContact) > *wait {
+				log.Fatalf("lost the coordinator (%s)", err)
+			}
+			time.Sleep(pollInterval)
+			continue
+		}
+		lastContact = time.Now()
+		var u unit
+		switch resp.StatusCode {
+		case http.StatusGone:
+			resp.Body.Close()
+			log.Printf("done, tested %d units", tested)
+			return
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&u)
+			resp.Body.Close()
+			if err != nil {
+				log.Fatalf("failed to parse unit (%s)", err)
+			}
+		default:
+			resp.Body.Close()
+			time.Sleep(pollInterval)
+			continue
+		}
+
+		if current == nil || current.Key != u.Job {
+			j, err := fetchJob(base)
+			if err != nil {
+				log.Fatalf("failed to fetch job (%s)", err)
+			}
+			if j == nil || j.Key != u.Job {
+				continue // the coordinator moved on
+			}
+			current = &workerJob{job: j}
+			if err = current.setup(*data, *traces); err != nil {
+				log.Fatalf("failed to set up job for work %s (%s)", j.Model.Works[0].Name, err)
+			}
+			log.Printf("set up work %s", j.Model.Works[0].Name)
+		}
+
+		results, err := current.test(u, runtime.NumCPU()**workerFactor)
+		if err != nil {
+			log.Fatalf("failed to test unit %d (%s)", u.ID, err)
+		}
+		res := unitResult{ID: u.ID, Job: u.Job, Worker: *name, Results: make(map[string][5]int)}
+		for attack, m := range results {
+			res.Results[attack] = counts(m)
+		}
+		body, err := json.Marshal(res)
+		if err != nil {
+			log.Fatalf("failed to encode results (%s)", err)
+		}
+		resp, err = http.Post(base+"/result", "application/json", bytes.NewReader(body))
+		if err != nil {
+			// the unit is handed out again once its lease runs out
+			log.Printf("failed to send results of unit %d (%s)", u.ID, err)
+			continue
+		}
+		resp.Body.Close()
+		tested++
+		log.Printf("tested unit %d (fold %d, instances %d-%d)", u.ID, u.Fold, u.From, u.To-1)
+	}
+}
+
+func fetchJob(base string) (*job, error) {
+	resp, err := http.Get(base + "/job")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("coordinator replied %s", resp.Status)
+	}
+	j := new(job)
+	if err = json.NewDecoder(resp.Body).Decode(j); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
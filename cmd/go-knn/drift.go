@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parsePeriods parses comma-separated periods and ranges of periods (e.g.,
+// "1-2" or "3,5,7-9"), numbered from 1.
+func parsePeriods(s string) (periods []int, err error) {
+	for _, item := range strings.Split(s, ",") {
+		from, to := item, item
+		if index := strings.Index(item, "-"); index != -1 {
+			from, to = item[:index], item[index+1:]
+		}
+		a, err := strconv.Atoi(strings.TrimSpace(from))
+		if err != nil {
+			return nil, fmt.Errorf("bad period %q", item)
+		}
+		b, err := strconv.Atoi(strings.TrimSpace(to))
+		if err != nil || a < 1 || b < a {
+			return nil, fmt.Errorf("bad period %q", item)
+		}
+		for p := a; p <= b; p++ {
+			periods = append(periods, p)
+		}
+	}
+	return
+}
+
+// timePeriods are the periods to train on and the periods to test on, one
+// testing period per fold.
+func timePeriods() (train, test []int, err error) {
+	if *period <= 0 {
+		return nil, nil, fmt.Errorf("need a positive period")
+	}
+	if *testPeriods == "" {
+		return nil, nil, fmt.Errorf("need periods to test on (-test-periods)")
+	}
+	if train, err = parsePeriods(*trainPeriods); err != nil {
+		return
+	}
+	if test, err = parsePeriods(*testPeriods); err != nil {
+		return
+	}
+	for _, t := range test {
+		for _, p := range train {
+			if t == p {
+				return nil, nil, fmt.Errorf("period %d is for both training and testing", t)
+			}
+		}
+	}
+	return
+}
+
+// gap is the number of periods between the last training period and a
+// testing period.
+func gap(train []int, test int) int {
+	last := 0
+	for _, p := range train {
+		if p > last {
+			last = p
+		}
+	}
+	return test - last
+}
+
+// instanceTimes are the collection times of the instances in files, from the
+// -timestamps file (by path relative to the work dir) if set, otherwise the
+// times in the manifest or the modification times of the files in dir.
+func instanceTimes(dir string, files []string) ([]time.Time, error) {
+	times := make([]time.Time, len(files))
+	if *timestamps == "" && manifest != nil {
+		for i, f := range files {
+			e := manifest.byPath[path.Clean(f)]
+			if e == nil || e.Time == "" {
+				return nil, fmt.Errorf("no time for %s in the manifest", f)
+			}
+			t, err := parseTime(e.Time)
+			if err != nil {
+				return nil, fmt.Errorf("bad time %q of %s in the manifest", e.Time, f)
+			}
+			times[i] = t
+		}
+		return times, nil
+	}
+	if *timestamps == "" {
+		for i, f := range files {
+			info, err := os.Stat(path.Join(dir, f))
+			if err != nil {
+				return nil, err
+			}
+			times[i] = info.ModTime()
+		}
+		return times, nil
+	}
+
+	file, err := os.Open(*timestamps)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	stamps := make(map[string]time.Time)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		items := strings.Split(scanner.Text(), ",")
+		if len(items) != 2 {
+			return nil, fmt.Errorf("expected file,time in line %d of %s", line, *timestamps)
+		}
+		t, err := parseTime(items[1])
+		if err != nil {
+			if line == 1 {
+				continue // header
+			}
+			return nil, fmt.Errorf("bad time %q in line %d of %s", items[1], line, *timestamps)
+		}
+		key := path.Clean(strings.TrimSpace(items[0]))
+		if _, exists := stamps[key]; exists {
+			return nil, fmt.Errorf("%s is in %s twice", key, *timestamps)
+		}
+		stamps[key] = t
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, err
+	}
+	for i, f := range files {
+		t, exists := stamps[path.Clean(f)]
+		if !exists {
+			return nil, fmt.Errorf("no time for %s in %s", f, *timestamps)
+		}
+		times[i] = t
+	}
+	return times, nil
+}
+
+// parseTime parses a time as RFC 3339 or as (fractional) Unix seconds.
+func parseTime(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	seconds, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(0, int64(seconds*1e9)), nil
+}
+
+// timeSplit trains on the instances collected in the training periods and
+// tests on those of one testing period per fold, counting periods from the
+// earliest instance. Instances in other periods are ignored.
+func timeSplit(times []time.Time) (Splitter, error) {
+	train, test, err := timePeriods()
+	if err != nil {
+		return nil, err
+	}
+	start := times[0]
+	for _, t := range times {
+		if t.Before(start) {
+			start = t
+		}
+	}
+	training := make(map[int]bool)
+	for _, p := range train {
+		training[p] = true
+	}
+
+	s := newTableSplit("time", len(test), len(times))
+	s.trainOnly()
+	for f, p := range test {
+		tested := 0
+		for i, t := range times {
+			instancePeriod := int(t.Sub(start)/(*period)) + 1
+			s.testing[f][i] = instancePeriod == p
+			s.training[f][i] = training[instancePeriod]
+			if s.testing[f][i] {
+				tested++
+			}
+		}
+		if tested == 0 {
+			log.Printf("warning: no instances in testing period %d", p)
+		}
+	}
+	// WLLCC learns on every monitored site, with more instances than good
+	// neighbours
+	for site := 0; site < *sites; site++ {
+		trained := 0
+		for i := site * *instances; i < (site+1)**instances; i++ {
+			if s.training[0][i] {
+				trained++
+			}
+		}
+		if trained == 0 {
+			return nil, fmt.Errorf("no instances of site %d in the training periods", site)
+		}
+		if anyWeighted(distMetrics) && trained <= *recoPoints {
+			return nil, fmt.Errorf("%d instances of site %d in the training periods, WLLCC needs more than %d (-wreco)",
+				trained, site, *recoPoints)
+		}
+	}
+	return s, nil
+}
+
+// writeDrift writes the metrics of each testing period of a time split by
+// the gap to the training periods.
+func writeDrift(results []map[string][]metrics, // work -> map["attack"] -> [folds]metrics
+	subfold []string, name string) {
+	train, test, err := timePeriods()
+	if err != nil {
+		return
+	}
+	out := bytes.NewBufferString("work,attack,period,gap,recall,precision,f1score,fpr,accuracy\n")
+	for sub := 0; sub < len(subfold); sub++ {
+		var attacks []string
+		for attack := range results[sub] {
+			attacks = append(attacks, attack)
+		}
+		sort.Strings(attacks)
+		for _, attack := range attacks {
+			m := results[sub][attack]
+			for f := 0; f < len(m) && f < len(test); f++ {
+				if c := m[f]; c.tp+c.fpp+c.fnp+c.fn+c.tn == 0 {
+					continue // no instances in the testing period
+				}
+				str2buf(fmt.Sprintf("%s,%s,%d,%d,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+					csvField(subfold[sub]), attack, test[f], gap(train, test[f]),
+					recall(m[f:f+1]), precision(m[f:f+1]), f1score(m[f:f+1]),
+					fpr(m[f:f+1]), accuracy(m[f:f+1])), out)
+			}
+		}
+	}
+	writeFile(out.String(), name)
+}
@@ -1,20 +1,24 @@
 /*
 Package main implements the kNN website fingerprinting attack by Wang et al.,
-providing support for folders of work and multiple cores.
+providing support for folders of work and multiple cores. The go-knn binary
+covers the whole pipeline with subcommands: extract, train, eval, classify,
+serve, inspect, and convert.
 */
 package main
 
 import (
 	"bytes"
+	"context"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
-	"math/rand"
+	"os"
 	"path"
 	"runtime"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -32,56 +36,233 @@ const (
 	FeatNum int = 1225
 	// FeatureSuffix is the suffix of files containing features.
 	FeatureSuffix = ".feat"
-	// RecoPointsNum is the number of neighbours for distance learning.
+	// RecoPointsNum is the default number of neighbours for distance learning.
 	RecoPointsNum int = 5
 )
 
 var (
 	// datset
-	sites     = flag.Int("sites", 0, "number of sites")
-	instances = flag.Int("instances", 0, "number of instances")
-	open      = flag.Int("open", 0, "number of open-world sites")
-	roffset   = flag.Int("roffset", 0, "the offset to read monitored sites from")
+	sites         = flag.Int("sites", 0, "number of sites")
+	instances     = flag.Int("instances", 0, "number of instances")
+	open          = flag.Int("open", 0, "number of open-world instances")
+	openInstances = flag.Int("open-instances", 1,
+		"the most instances to read of each unmonitored site, all in the same fold if more than one (implies -unseen-open)")
+	roffset      = flag.Int("roffset", 0, "the offset to read monitored sites from")
+	manifestFile = flag.String("manifest", "",
+		"CSV or JSON manifest mapping the files of the data dir to sites, instances and works")
+	testData = flag.String("test-data", "",
+		"folder with instances to test on, matched by site, learning on all of the data dir instead of cross-validating")
 
 	// Wa-kNN-related
-	weightRounds = flag.Int("r", 2500, "rounds for WLLCC weight learning in kNN")
-	wKmin        = flag.Int("wKmin", 1, "the smallest k to test for with Wa-kNN")
-	wKmax        = flag.Int("wKmax", 2, "the biggest k to test for with Wa-kNN")
-	wKstep       = flag.Int("wKstep", 1, "the step size between wKmin and wKmax")
+	wKmin      = flag.Int("wKmin", 1, "the smallest k to test for with Wa-kNN")
+	wKmax      = flag.Int("wKmax", 2, "the biggest k to test for with Wa-kNN")
+	wKstep     = flag.Int("wKstep", 1, "the step size between wKmin and wKmax")
+	metricList = flag.String("metric", "l1",
+		"comma-separated distance metrics to run Wa-kNN with ("+
+			strings.Join(metricNames, ", ")+"), each is its own attack")
+	norm = flag.String("norm", "none",
+		"per-feature normalization fitted on training folds ("+
+			strings.Join(normNames, ", ")+")")
+	sweepOpen = flag.String("sweep-open", "",
+		"comma-separated numbers of unmonitored training sites to also evaluate with, reusing the weights")
+	sweepOpenTest = flag.String("sweep-open-test", "",
+		"comma-separated numbers of unmonitored testing sites for -sweep-open (default: all)")
+
+	// WLLCC weight learning
+	weightRounds  = flag.Int("r", 2500, "rounds for WLLCC weight learning in kNN")
+	weightRate    = flag.Float64("wrate", 0.01, "the WLLCC learning rate")
+	recoPoints    = flag.Int("wreco", RecoPointsNum, "the number of good and bad neighbours in WLLCC")
+	weightInitMin = flag.Float64("winitmin", 0.5, "the smallest initial WLLCC weight")
+	weightInitMax = flag.Float64("winitmax", 1.5, "the biggest initial WLLCC weight")
+	weightTrace   = flag.String("wtrace", "",
+		"file to write per-round WLLCC convergence statistics to (CSV)")
+	earlyStop = flag.Int("estop", 0,
+		"stop WLLCC after this many held-out evaluations without improvement (0 disables)")
+	earlyHoldout = flag.Float64("eholdout", 0.1,
+		"the fraction of each training fold held out for WLLCC early stopping")
+	earlyEvery = flag.Int("eevery", 250,
+		"the number of WLLCC rounds between held-out evaluations for early stopping")
+
+	// WLLCC hyperparameter tuning
+	tune = flag.String("tune", "",
+		"tune WLLCC hyperparameters by nested cross-validation (grid or random)")
+	tuneFolds  = flag.Int("tunefolds", 3, "the number of inner folds for tuning")
+	tuneTrials = flag.Int("tunetrials", 10, "the number of candidates for random tuning")
+	tuneRate   = flag.String("tunerate", "0.005,0.01,0.02",
+		"comma-separated WLLCC learning rates to tune over")
+	tuneReco = flag.String("tunereco", "3,5,7",
+		"comma-separated WLLCC neighbour counts to tune over")
+	tuneInit = flag.String("tuneinit", "0.5:1.5,0.9:1.1",
+		"comma-separated min:max initial WLLCC weight ranges to tune over")
+
+	// streaming classification
+	traces = flag.String("traces", "",
+		"folder with the cell traces of the feature files (default: the data dir)")
+	streamCells = flag.Int("stream", 0,
+		"also classify test traces after every this many cells, as they arrive")
+	streamTime = flag.Float64("stream-time", 0,
+		"also classify test traces after every this many seconds, as they arrive")
+	streamPoints = flag.Int("stream-points", 10,
+		"the number of streaming checkpoints to classify at")
+	prefixList = flag.String("prefixes", "",
+		"comma-separated trace prefixes to also classify test traces truncated to (e.g., 10%,50%,100c,2s)")
+
+	// models
+	loadWeights = flag.String("load-weights", "",
+		"model file to load normalization and weights from, skipping WLLCC")
+	embed = flag.Bool("embed", false,
+		"embed the features of training instances in the written model file")
 
 	// experiment tweaks
 	workerFactor = flag.Int("f", 1,
 		"the factor to multiply NumCPU with for creating workers")
 	folds = flag.Int("folds", 10,
 		"we perform k-fold cross-validation")
+	splitName = flag.String("split", "contiguous",
+		"how to split instances into folds ("+strings.Join(splitNames, ", ")+")")
+	repeats   = flag.Int("repeats", 5, "the number of shuffled k-fold splits for the repeated split")
+	holdout   = flag.Float64("holdout", 0.2, "the fraction of instances to test for the holdout split")
+	seed      = flag.Int64("seed", 1, "the seed of shuffled splits")
+	splitFile = flag.String("split-file", "",
+		"file with the split to use, as written to the .split file of a run")
+	trainInstances = flag.Int("train-instances", 0,
+		"the number of training instances per monitored site drawn from each training fold (0: all)")
+	openByNumber = flag.Bool("open-by-number", false,
+		"test the open-world instances with the instance numbers of the monitored instances of a fold of the contiguous split, as go-knn did before (default: a contiguous range of unmonitored sites)")
+	unseenOpen = flag.Bool("unseen-open", false,
+		"keep all instances of an unmonitored site in one fold, such that sites seen in training are never tested")
+	period       = flag.Duration("period", 7*24*time.Hour, "the length of a period of the time split")
+	trainPeriods = flag.String("train-periods", "1-2",
+		"the periods to train on for the time split, counted from the earliest instance")
+	testPeriods = flag.String("test-periods", "",
+		"the periods to test on for the time split, one per fold (e.g., 3-8)")
+	timestamps = flag.String("timestamps", "",
+		"CSV file with the file (relative to the work dir),time an instance was collected (default: the file modification time)")
+	checkpointDir = flag.String("checkpoint", "",
+		"folder to write per-fold checkpoints of weights and results to as they complete")
+	resume = flag.Bool("resume", false,
+		"skip the folds completed in the checkpoint folder (the WLLCC trace only covers learning in this run)")
+	coordinate = flag.String("coordinate", "",
+		"address to hand out testing to workers on (go-knn worker) instead of testing locally")
+	curve = flag.String("curve", "",
+		"comma-separated numbers of training instances per monitored site to evaluate a learning curve over")
+	unitSize = flag.Int("unit", 100, "the number of instances per unit handed out to workers")
+	lease    = flag.Duration("lease", 5*time.Minute,
+		"how long a worker has to test a unit before it is handed out again")
+	threadCount = flag.Int("threads", 0,
+		"the most goroutines learning weights at once, across folds and within rounds (default: NumCPU*f)")
+	outDir = flag.String("out", "",
+		"the folder to write results and the model to (default: the current folder)")
 	verboseOutput = flag.Bool("verbose", true, "print detailed result output")
 	quiet         = flag.Bool("quiet", false,
 		"don't print detailed progress (useful for not spamming docker log)")
 
 	datadir = ""
+	// distMetrics are the metrics to run the attack with
+	distMetrics []Metric
+	// prefixSpecs are the prefixes to truncate test traces to
+	prefixSpecs []prefixSpec
 )
 
-func main() {
-	rand.Seed(time.Now().UnixNano())
-	flag.Parse()
-	if *sites == 0 || *instances == 0 {
-		log.Println("missing sites and/or instances argument")
-		flag.Usage()
-		return
+// experiment learns weights for all work in datadir and, if evaluate is set,
+// evaluates the attack with k-fold cross-validation, returning the results of
+// each work. If ctx is cancelled, in-flight work is finished and the results
+// so far are written marked as incomplete.
+func experiment(ctx context.Context, evaluate bool) (results []map[string][]metrics,
+	subfold []string) {
+	var err error
+	distMetrics, err = parseMetrics(*metricList)
+	if err != nil {
+		log.Fatalf("failed to parse metrics (%s)", err)
+	}
+	if *earlyStop > 0 && (*earlyHoldout <= 0 || *earlyHoldout >= 1 || *earlyEvery <= 0) {
+		log.Fatalf("early stopping needs 0 < eholdout < 1 and eevery > 0")
+	}
+	if err = checkParams(defaultParams(), 0); err != nil {
+		log.Fatalf("bad WLLCC hyperparameters (%s)", err)
+	}
+	var candidates []wllccParams
+	if *tune != "" {
+		if *tuneFolds < 2 {
+			log.Fatalf("tuning needs at least 2 inner folds")
+		}
+		candidates, err = tuneCandidates()
+		if err != nil {
+			log.Fatalf("failed to set up tuning (%s)", err)
+		}
 	}
-	if len(flag.Args()) == 0 {
-		log.Fatal("need to specify data dir")
+	if !isNorm(*norm) {
+		log.Fatalf("unknown normalization %q (supported: %s)",
+			*norm, strings.Join(normNames, ", "))
 	}
-	datadir = flag.Arg(0)
 
-	// can traces be split into k samples?
-	if *instances%*folds != 0 || *open%*folds != 0 {
-		log.Fatalf("error: k (%d) has to fold instances (%d) and open (%d) evenly",
-			*folds, *instances, *open)
+	if *streamCells > 0 && *streamTime > 0 {
+		log.Fatalf("stream by either cells or time, not both")
 	}
+	if streaming() && *streamPoints < 1 {
+		log.Fatalf("need at least one streaming checkpoint")
+	}
+	if prefixSpecs, err = parsePrefixSpecs(*prefixList); err != nil {
+		log.Fatalf("failed to parse prefixes (%s)", err)
+	}
+	if err = parseSweep(); err != nil {
+		log.Fatalf("failed to parse open-world sweep (%s)", err)
+	}
+
+	if *outDir != "" {
+		if err = os.MkdirAll(*outDir, 0777); err != nil {
+			log.Fatalf("failed to create output folder (%s)", err)
+		}
+	}
+
+	if *resume && *checkpointDir == "" {
+		log.Fatalf("resuming needs a checkpoint folder")
+	}
+	if *checkpointDir != "" {
+		if err = os.MkdirAll(*checkpointDir, 0777); err != nil {
+			log.Fatalf("failed to create checkpoint folder (%s)", err)
+		}
+	}
+
+	initThreads(*threadCount)
+
+	var coord *coordinator
+	if *coordinate != "" && evaluate {
+		if *unitSize < 1 {
+			log.Fatalf("units need at least one instance")
+		}
+		if *testData != "" {
+			log.Fatalf("testing on other data cannot be distributed")
+		}
+		if coord, err = newCoordinator(*coordinate, *lease); err != nil {
+			log.Fatalf("failed to coordinate (%s)", err)
+		}
+		defer coord.finish()
+	}
+
+	var loaded *modelFile
+	if *loadWeights != "" {
+		if loaded, err = loadModel(*loadWeights); err != nil {
+			log.Fatalf("failed to load model (%s)", err)
+		}
+		if loaded.Sites != *sites || loaded.Instances != *instances || loaded.Open != *open {
+			log.Printf("warning: model learned on %dx%d+%d, evaluating on %dx%d+%d",
+				loaded.Sites, loaded.Instances, loaded.Open, *sites, *instances, *open)
+		}
+		log.Printf("loaded model %s (created %s)", *loadWeights, loaded.Created)
+	}
+
+	// the instances of each work are split into folds once read
+	nfolds, err := splitFolds()
+	if err != nil {
+		log.Fatalf("failed to split instances (%s)", err)
+	}
+	if loaded != nil && loaded.Folds != nfolds {
+		log.Fatalf("model has %d folds, run has %d", loaded.Folds, nfolds)
+	}
+	splitOut := bytes.NewBufferString(SplitHeader + "\n")
 
 	// find subfolders, do run for all of them, then print results
-	var subfold []string
 	files, err := ioutil.ReadDir(datadir)
 	if err != nil {
 		log.Fatalf("failed to read data folder (%s)", err)
@@ -91,6 +272,14 @@ func main() {
 			subfold = append(subfold, f.Name())
 		}
 	}
+	if *manifestFile != "" {
+		if manifest, err = loadManifest(*manifestFile); err != nil {
+			log.Fatalf("failed to load manifest (%s)", err)
+		}
+		subfold = manifest.works()
+	} else {
+		manifest = nil
+	}
 	if len(subfold) == 0 { // no subfolder, assume data folder is full of work
 		subfold = append(subfold, datadir)
 	}
@@ -98,98 +287,476 @@ func main() {
 	log.Printf("found %d folder(s) with work", len(subfold))
 
 	// results is work -> map["attack"] -> [folds]metrics
-	results := make([]map[string][]metrics, len(subfold))
-	// allWeights is work -> fold -> features -> weight
-	allWeights := make([][][]float64, len(subfold))
-	for sub := 0; sub < len(subfold); sub++ {
+	results = make([]map[string][]metrics, len(subfold))
+	// allWeights is work -> fold -> metric -> features -> weight
+	allWeights := make([][][][]float64, len(subfold))
+	// allStats is work -> fold -> metric -> round -> WLLCC statistics
+	allStats := make([][][][]roundStats, len(subfold))
+	// allTuning is work -> fold -> metric -> tuned WLLCC hyperparameters
+	allTuning := make([][][]tuning, len(subfold))
+	model := newModelFile(nfolds)
+	// incomplete describes where the run was interrupted
+	incomplete := ""
+	for sub := 0; sub < len(subfold) && incomplete == ""; sub++ {
 		results[sub] = make(map[string][]metrics)
 		log.Printf("starting with work %s", subfold[sub])
 
 		// read cells from datadir
 		log.Println("\tattempting to read WF features...")
 		var feat, openfeat [][]float64
-		if subfold[sub] == datadir && len(subfold) == 1 { // likely no subfolders
-			feat, openfeat = readFeatures(subfold[sub])
-		} else { // need full path
-			feat, openfeat = readFeatures(path.Join(datadir, subfold[sub]))
+		var files []string
+		workdir := subfold[sub]
+		if manifest != nil { // paths are relative to the data dir
+			workdir = datadir
+		} else if subfold[sub] != datadir || len(subfold) != 1 { // need full path
+			workdir = path.Join(datadir, subfold[sub])
+		}
+		feat, openfeat, files = readWork(workdir, subfold[sub])
+		tracedir := workdir
+		if *traces != "" {
+			tracedir = *traces
+			if workdir != datadir {
+				tracedir = path.Join(*traces, subfold[sub])
+			}
+		}
+		var loadedWork *workModel
+		if loaded != nil {
+			if loadedWork, err = loaded.work(subfold[sub]); err != nil {
+				log.Fatalf("failed to find work in model (%s)", err)
+			}
 		}
 
 		log.Printf("\tread %d sites with %d instances (in total %d)",
 			*sites, *instances, len(feat))
-		log.Printf("\tread %d sites for open world", len(openfeat))
+		log.Printf("\tread %d instances of %d sites for open world", len(openfeat),
+			len(openGroups(files, true)))
+
+		// the instances to test, of the test data dir if set
+		testFeat, testOpenfeat, testFiles, testTracedir := feat, openfeat, files, tracedir
+		if *testData != "" {
+			testdir := *testData
+			if workdir != datadir {
+				testdir = path.Join(*testData, subfold[sub])
+			}
+			testFeat, testOpenfeat, testFiles = readWork(testdir, subfold[sub])
+			if *traces == "" { // -traces are of the test data
+				testTracedir = testdir
+			}
+			if len(testFiles) != len(files) {
+				log.Fatalf("test data has %d instances, data has %d", len(testFiles), len(files))
+			}
+			log.Printf("\tread %d instances to test from %s", len(testFiles), testdir)
+		}
 
-		testPerFold := (*sites**instances + *open) / *folds
+		// split the instances into folds, for loaded weights as they were
+		// learned
+		if split, err = workSplit(subfold[sub], workdir, files, loadedWork); err != nil {
+			log.Fatalf("failed to split instances (%s)", err)
+		}
+		if split.Folds() != nfolds {
+			log.Fatalf("split of work has %d folds, run has %d", split.Folds(), nfolds)
+		}
+		if *trainInstances > 0 {
+			if split, err = limitTraining(split, *trainInstances, len(files), *seed); err != nil {
+				log.Fatalf("failed to limit training instances (%s)", err)
+			}
+		}
+		if anyWeighted(distMetrics) && loadedWork == nil {
+			if err = checkReco(nfolds, candidates); err != nil {
+				log.Fatalf("bad WLLCC hyperparameters for the split (%s)", err)
+			}
+		}
+		log.Printf("\tsplit instances into %d folds (%s)", nfolds, split.Name())
+		setOpenSites(files, testFiles)
+		if err = checkSweep(nfolds, len(files)-len(feat)); err != nil {
+			log.Fatalf("failed to sweep the open world (%s)", err)
+		}
+		splitRows(split, subfold[sub], files, splitOut)
+		writeFile(splitOut.String(), outputName(".split"))
 
-		// calculate global weights for kNN in parallel (they don't change in folds)
-		globalWeights := make([][]float64, *folds)
-		wg := new(sync.WaitGroup)
-		for fold := 0; fold < *folds; fold++ {
-			wg.Add(1)
-			go func(i int) {
-				defer wg.Done()
-				globalWeights[i] = wllcc(feat, openfeat, i)
-			}(fold)
+		// normalize features for each fold, fitted only on the training fold
+		// unless loaded from a model
+		foldFeat := make([][][]float64, nfolds)
+		foldOpenfeat := make([][][]float64, nfolds)
+		foldScalers := make([]*scaler, nfolds)
+		foldTestFeat := make([][][]float64, nfolds)
+		foldTestOpenfeat := make([][][]float64, nfolds)
+		for fold := 0; fold < nfolds; fold++ {
+			if loadedWork != nil {
+				f, err := loadedWork.fold(fold)
+				if err != nil {
+					log.Fatalf("failed to load fold (%s)", err)
+				}
+				foldScalers[fold] = f.scaler()
+			} else {
+				foldScalers[fold], err = fitScaler(*norm, feat, openfeat, fold)
+				if err != nil {
+					log.Fatalf("failed to fit normalization (%s)", err)
+				}
+			}
+			foldFeat[fold], foldOpenfeat[fold] = feat, openfeat
+			foldTestFeat[fold], foldTestOpenfeat[fold] = testFeat, testOpenfeat
+			if foldScalers[fold].Method != "none" {
+				foldFeat[fold] = foldScalers[fold].transformAll(feat)
+				foldOpenfeat[fold] = foldScalers[fold].transformAll(openfeat)
+				if *testData != "" {
+					foldTestFeat[fold] = foldScalers[fold].transformAll(testFeat)
+					foldTestOpenfeat[fold] = foldScalers[fold].transformAll(testOpenfeat)
+				}
+			}
+		}
+		if foldScalers[0].Method != "none" {
+			log.Printf("\tnormalized features (%s) for all folds", foldScalers[0].Method)
 		}
-		wg.Wait()
-		log.Printf("\tdetermined global kNN-weights for all folds")
 
-		for fold := 0; fold < *folds; fold++ {
-			log.Printf("\tstarting fold %d/%d", fold+1, *folds)
+		// completed folds of an earlier run
+		resumed := make([]*checkpoint, nfolds)
+		if *resume {
+			n := 0
+			for fold := 0; fold < nfolds; fold++ {
+				if resumed[fold], err = loadCheckpoint(subfold[sub], fold); err != nil {
+					log.Fatalf("failed to resume (%s)", err)
+				}
+				if resumed[fold] != nil {
+					n++
+				}
+			}
+			log.Printf("\tresuming %d fold(s) from checkpoints", n)
+		}
 
-			// start workers
-			workerIn := make(chan int)
-			workerOut := make(chan map[string]metrics,
-				(*sites**instances+*open) / *folds + 1000)
-			wg := new(sync.WaitGroup)
-			for i := 0; i < runtime.NumCPU()**workerFactor; i++ {
+		// calculate global weights for kNN in parallel (they don't change in
+		// folds), learning weights only for metrics where weights make sense
+		globalWeights := make([][][]float64, nfolds)
+		foldParams := make([][]wllccParams, nfolds)
+		allStats[sub] = make([][][]roundStats, nfolds)
+		allTuning[sub] = make([][]tuning, nfolds)
+		// checkpoint each fold once all its weights are learned
+		pending := make([]int, nfolds)
+		var pendingMutex sync.Mutex
+		wg := new(sync.WaitGroup)
+		for fold := 0; fold < nfolds; fold++ {
+			globalWeights[fold] = make([][]float64, len(distMetrics))
+			foldParams[fold] = make([]wllccParams, len(distMetrics))
+			allStats[sub][fold] = make([][]roundStats, len(distMetrics))
+			allTuning[sub][fold] = make([]tuning, len(distMetrics))
+			for m := 0; m < len(distMetrics); m++ {
+				if distMetrics[m].Weighted() && resumed[fold] == nil && loadedWork == nil {
+					pending[fold]++
+				}
+			}
+			for m := 0; m < len(distMetrics); m++ {
+				if !distMetrics[m].Weighted() {
+					globalWeights[fold][m] = unitWeights()
+					continue
+				}
+				if c := resumed[fold]; c != nil {
+					globalWeights[fold][m], _ = c.weights(distMetrics[m].Name())
+					foldParams[fold][m] = c.params(distMetrics[m].Name())
+					allTuning[sub][fold][m].params = foldParams[fold][m]
+					if *tune != "" {
+						allTuning[sub][fold][m].score = c.Tuning[m]
+					}
+					continue
+				}
+				if loadedWork != nil {
+					f, _ := loadedWork.fold(fold)
+					globalWeights[fold][m], err = f.weights(distMetrics[m].Name())
+					if err != nil {
+						log.Fatalf("failed to load weights (%s)", err)
+					}
+					foldParams[fold][m] = f.params(distMetrics[m].Name())
+					continue
+				}
 				wg.Add(1)
-				go func() {
+				go func(i, m int) {
 					defer wg.Done()
-					for j := range workerIn {
-						workerOut <- test(j,
-							fold, globalWeights[fold],
-							feat, openfeat)
+					acquire()
+					defer release()
+					p := defaultParams()
+					if *tune != "" {
+						allTuning[sub][i][m] = tuneWLLCC(ctx, foldFeat[i], foldOpenfeat[i],
+							i, distMetrics[m], candidates)
+						p = allTuning[sub][i][m].params
+						log.Printf("\ttuned WLLCC for fold %d (%s): rate %g, reco %d, init [%g, %g], accuracy %.3f",
+							i+1, distMetrics[m].Name(), p.rate, p.reco, p.initMin, p.initMax,
+							allTuning[sub][i][m].score)
+					}
+					foldParams[i][m] = p
+					globalWeights[i][m], allStats[sub][i][m] =
+						wllcc(ctx, foldFeat[i], foldOpenfeat[i], i, distMetrics[m], p, nil)
+					if ctx.Err() != nil {
+						return // weights are not completely learned
+					}
+
+					pendingMutex.Lock()
+					pending[i]--
+					learned := pending[i] == 0
+					pendingMutex.Unlock()
+					if learned && *checkpointDir != "" {
+						if err := saveCheckpoint(subfold[sub], i, foldScalers[i],
+							globalWeights[i], foldParams[i], allTuning[sub][i], nil); err != nil {
+							log.Fatalf("failed to write checkpoint (%s)", err)
+						}
+					}
+				}(fold, m)
+			}
+		}
+		wg.Wait()
+		if ctx.Err() != nil {
+			incomplete = fmt.Sprintf("interrupted while learning weights for work %s", subfold[sub])
+			results, subfold = results[:sub], subfold[:sub]
+			break
+		}
+		if loadedWork != nil {
+			log.Printf("\tloaded global kNN-weights for all folds")
+		} else {
+			log.Printf("\tdetermined global kNN-weights for all folds")
+		}
+
+		// add the learned model of the work
+		wm := newWorkModel(subfold[sub], workdir, feat, openfeat, files, *embed)
+		for fold := 0; fold < nfolds; fold++ {
+			wm.addFold(fold, foldScalers[fold], globalWeights[fold], foldParams[fold])
+		}
+		model.Works = append(model.Works, wm)
+
+		// save weights for all folds
+		allWeights[sub] = globalWeights
+		if !evaluate {
+			continue
+		}
+
+		// test with workers, each fold as if tested locally below
+		var distributed []map[string]metrics
+		// partial are the folds not completely tested when interrupted
+		partial := make([]bool, nfolds)
+		if coord != nil {
+			subdir := ""
+			if workdir != datadir {
+				subdir = subfold[sub]
+			}
+			skip := make([]bool, nfolds)
+			for fold := 0; fold < nfolds; fold++ {
+				skip[fold] = resumed[fold] != nil && resumed[fold].Results != nil
+			}
+			var complete []bool
+			distributed, complete = coord.evaluate(ctx, newJob(model, wm, subdir), skip, *unitSize)
+			for fold := 0; fold < nfolds; fold++ {
+				for attack, m := range distributed[fold] {
+					if _, exists := results[sub][attack]; !exists {
+						results[sub][attack] = make([]metrics, nfolds)
 					}
-				}()
+					results[sub][attack][fold] = m
+				}
+				if !skip[fold] && !complete[fold] {
+					partial[fold] = true
+					incomplete = fmt.Sprintf("interrupted in work %s before workers tested all units",
+						subfold[sub])
+				}
 			}
+		}
 
-			// for each testing instance
-			testing := 0
-			for i := 0; i < *sites**instances+*open; i++ {
-				if instanceForTesting(i, fold) {
-					workerIn <- i
-					testing++
-					if !*quiet {
-						fmt.Printf("\r\t\t\t\ttesting %d/%d (%d workers)",
-							testing, testPerFold, runtime.NumCPU()**workerFactor)
+		for fold := 0; fold < nfolds; fold++ {
+			if c := resumed[fold]; c != nil && c.Results != nil {
+				log.Printf("\tresumed fold %d/%d", fold+1, nfolds)
+				for attack, m := range c.foldResults() {
+					if _, exists := results[sub][attack]; !exists {
+						results[sub][attack] = make([]metrics, nfolds)
 					}
+					results[sub][attack][fold] = m
 				}
+				foldFeat[fold], foldOpenfeat[fold] = nil, nil
+				foldTestFeat[fold], foldTestOpenfeat[fold] = nil, nil
+				continue
 			}
-			if !*quiet {
-				fmt.Println("")
+			if distributed == nil {
+				log.Printf("\tstarting fold %d/%d", fold+1, nfolds)
+				testPerFold := 0
+				for i := 0; i < *sites**instances+*open; i++ {
+					if instanceForTesting(i, fold) {
+						testPerFold++
+					}
+				}
+
+				// start workers
+				workerIn := make(chan int)
+				workerOut := make(chan map[string]metrics,
+					testPerFold+1000)
+				wg := new(sync.WaitGroup)
+				for i := 0; i < runtime.NumCPU()**workerFactor; i++ {
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						for j := range workerIn {
+							var prefixes []prefix
+							if streaming() || len(prefixSpecs) > 0 {
+								prefixes = readPrefixes(traceFile(testTracedir, testFiles[j]),
+									foldScalers[fold])
+							}
+							testfeat := features(j, foldFeat[fold], foldOpenfeat[fold])
+							if *testData != "" {
+								testfeat = features(j, foldTestFeat[fold], foldTestOpenfeat[fold])
+							}
+							workerOut <- test(j, testfeat, prefixes,
+								fold, globalWeights[fold],
+								foldFeat[fold], foldOpenfeat[fold])
+						}
+					}()
+				}
+
+				// for each testing instance, until interrupted
+				testing := 0
+			schedule:
+				for i := 0; i < *sites**instances+*open; i++ {
+					if instanceForTesting(i, fold) {
+						select {
+						case workerIn <- i:
+						case <-ctx.Done():
+							break schedule
+						}
+						testing++
+						if !*quiet {
+							fmt.Printf("\r\t\t\t\ttesting %d/%d (%d workers)",
+								testing, testPerFold, runtime.NumCPU()**workerFactor)
+						}
+					}
+				}
+				if !*quiet {
+					fmt.Println("")
+				}
+
+				close(workerIn)
+				wg.Wait()
+				close(workerOut)
+
+				// save fold results
+				for res := range workerOut {
+					for attack, m := range res {
+						_, exists := results[sub][attack]
+						if !exists {
+							results[sub][attack] = make([]metrics, nfolds)
+						}
+						addResult(&results[sub][attack][fold], &m)
+					}
+				}
+
+				if ctx.Err() != nil {
+					partial[fold] = true
+					incomplete = fmt.Sprintf("interrupted in work %s, fold %d/%d after testing %d/%d instances",
+						subfold[sub], fold+1, nfolds, testing, testPerFold)
+				}
+			}
+			// folds workers finished before an interrupt are checkpointed too
+			if *checkpointDir != "" && !partial[fold] {
+				foldResults := make(map[string]metrics)
+				for attack, m := range results[sub] {
+					foldResults[attack] = m[fold]
+				}
+				if err = saveCheckpoint(subfold[sub], fold, foldScalers[fold],
+					globalWeights[fold], foldParams[fold], allTuning[sub][fold],
+					foldResults); err != nil {
+					log.Fatalf("failed to write checkpoint (%s)", err)
+				}
+			}
+
+			// release the fold's normalized features
+			foldFeat[fold], foldOpenfeat[fold] = nil, nil
+			foldTestFeat[fold], foldTestOpenfeat[fold] = nil, nil
+			if partial[fold] && distributed == nil {
+				break
+			}
+		}
+		if incomplete != "" {
+			results, subfold = results[:sub+1], subfold[:sub+1]
+		}
+	}
+
+	if incomplete != "" {
+		log.Printf("%s, not writing weights or model", incomplete)
+		if evaluate && len(subfold) > 0 {
+			writeResults(results, subfold, incomplete)
+		}
+		return
+	}
+	if evaluate {
+		writeResults(results, subfold, "")
+	}
+
+	// write weights file, only for metrics with learned weights
+	wout := bytes.NewBufferString("work,fold,metric") // ,f0,f1,....
+	for i := 0; i < FeatNum; i++ {
+		str2buf(fmt.Sprintf(",f%d", i+1), wout)
+	}
+	str2buf("\n", wout)
+	for i := 0; i < len(allWeights); i++ {
+		for j := 0; j < len(allWeights[i]); j++ {
+			for m := 0; m < len(distMetrics); m++ {
+				if !distMetrics[m].Weighted() {
+					continue
+				}
+				str2buf(fmt.Sprintf("%s,%d,%s", subfold[i], j, distMetrics[m].Name()), wout)
+				for k := 0; k < len(allWeights[i][j][m]); k++ {
+					str2buf(fmt.Sprintf(",%s",
+						strconv.FormatFloat(allWeights[i][j][m][k], 'f', -1, 64)), wout)
+				}
+				str2buf("\n", wout)
 			}
+		}
+	}
+	writeFile(wout.String(), outputName(".weights"))
 
-			close(workerIn)
-			wg.Wait()
-			close(workerOut)
+	// write the model file
+	if err = model.save(outputName(".model")); err != nil {
+		log.Fatalf("failed to write model (%s)", err)
+	}
 
-			// save fold results
-			for res := range workerOut {
-				for attack, m := range res {
-					_, exists := results[sub][attack]
-					if !exists {
-						results[sub][attack] = make([]metrics, *folds)
+	// write tuned WLLCC hyperparameters
+	if *tune != "" {
+		tout := bytes.NewBufferString("work,fold,metric,rate,reco,initmin,initmax,accuracy\n")
+		for i := 0; i < len(allTuning); i++ {
+			for j := 0; j < len(allTuning[i]); j++ {
+				for m := 0; m < len(allTuning[i][j]); m++ {
+					if !distMetrics[m].Weighted() {
+						continue
 					}
-					addResult(&results[sub][attack][fold], &m)
+					t := allTuning[i][j][m]
+					str2buf(fmt.Sprintf("%s,%d,%s,%g,%d,%g,%g,%.3f\n",
+						subfold[i], j, distMetrics[m].Name(), t.params.rate, t.params.reco,
+						t.params.initMin, t.params.initMax, t.score), tout)
 				}
 			}
 		}
-		// save weights for all folds
-		allWeights[sub] = globalWeights
+		writeFile(tout.String(), outputName(".tuning"))
+	}
+
+	// write WLLCC convergence trace
+	if *weightTrace != "" {
+		tout := bytes.NewBufferString("work,fold,metric,round,badinradius,weightchange,heldout\n")
+		for i := 0; i < len(allStats); i++ {
+			for j := 0; j < len(allStats[i]); j++ {
+				for m := 0; m < len(allStats[i][j]); m++ {
+					for _, s := range allStats[i][j][m] {
+						str2buf(fmt.Sprintf("%s,%d,%s,%d,%d,%s,%s\n",
+							subfold[i], j, distMetrics[m].Name(), s.round, s.badInRadius,
+							formatStat(s.weightChange), formatStat(s.heldOut)), tout)
+					}
+				}
+			}
+		}
+		writeFile(tout.String(), *weightTrace)
+	}
+	return
+}
 
+// writeResults prints and stores the results of all work. Incomplete results
+// are written to files marked as such, with a note on what is missing.
+func writeResults(results []map[string][]metrics, // work -> map["attack"] -> [folds]metrics
+	subfold []string, incomplete string) {
+	mark := ""
+	if incomplete != "" {
+		mark = "-incomplete"
 	}
 
-	// calculate results and store
 	output := make(map[string]string)
 	var attacks []string
 	for attack := range results[0] {
@@ -213,17 +780,28 @@ func main() {
 
 	// CSV files for recall and precision
 	generateCSV(recall,
-		fmt.Sprintf("%dx%d+%d-%s.csv",
-			*sites, *instances, *open, "recall"),
+		outputName(mark+"-recall.csv"),
 		results, attacks, subfold)
 	generateCSV(precision,
-		fmt.Sprintf("%dx%d+%d-%s.csv",
-			*sites, *instances, *open, "precision"),
+		outputName(mark+"-precision.csv"),
 		results, attacks, subfold)
+	if len(sweepTrain) > 0 {
+		writeSweep(results, subfold, outputName(mark+"-sweep.csv"))
+	}
+	if *splitName == "time" {
+		writeDrift(results, subfold, outputName(mark+"-drift.csv"))
+	}
+	if streaming() || len(prefixSpecs) > 0 {
+		writePrefixes(results, subfold, outputName(mark+"-prefixes.csv"))
+	}
 
 	// store a log to file of the complete run
 	flog := fmt.Sprintf("%s: wfdns for %dx%d+%d\n\n",
 		time.Now().String(), *sites, *instances, *open)
+	if incomplete != "" {
+		log.Printf("INCOMPLETE results: %s", incomplete)
+		flog += fmt.Sprintf("INCOMPLETE results: %s\n\n", incomplete)
+	}
 	for i := 0; i < len(attacks); i++ {
 		log.Printf("%s attack", attacks[i])
 		fmt.Printf("%s\n", output[attacks[i]])
@@ -231,41 +809,66 @@ func main() {
 		flog += fmt.Sprintf("%s attack\n%s\n", attacks[i], output[attacks[i]])
 	}
 	writeFile(flog,
-		fmt.Sprintf("%dx%d+%d.log",
-			*sites, *instances, *open))
-
-	// write weights file
-	wout := bytes.NewBufferString("work,fold") // ,f0,f1,....
-	for i := 0; i < len(allWeights[0][0]); i++ {
-		str2buf(fmt.Sprintf(",f%d", i+1), wout)
-	}
-	str2buf("\n", wout)
-	for i := 0; i < len(allWeights); i++ {
-		for j := 0; j < len(allWeights[i]); j++ {
-			str2buf(fmt.Sprintf("%s,%d", subfold[i], j), wout)
-			for k := 0; k < len(allWeights[i][j]); k++ {
-				str2buf(fmt.Sprintf(",%s",
-					strconv.FormatFloat(allWeights[i][j][k], 'f', -1, 64)), wout)
-			}
-			str2buf("\n", wout)
-		}
-	}
-	writeFile(wout.String(), fmt.Sprintf("%dx%d+%d.weights",
-		*sites, *instances, *open))
+		outputName(mark+".log"))
 }
 
-func test(i int, // test-specific
-	fold int, globalWeight []float64, // fold-specific
+// test classifies instance i with features testfeat among the training
+// instances of the fold in feat and openfeat.
+func test(i int, testfeat []float64, prefixes []prefix, // test-specific
+	fold int, globalWeights [][]float64, // fold-specific, one per metric
 	feat, openfeat [][]float64) (result map[string]metrics) {
 	result = make(map[string]metrics)
 
-	wKclasses, trueclass := classify(i, feat, openfeat,
-		globalWeight, *wKmax, fold)
+	trueclass := classOf(i)
+	for m := 0; m < len(distMetrics); m++ {
+		distList := distances(testfeat, feat, openfeat, globalWeights[m], distMetrics[m],
+			func(j int) bool {
+				return !instanceForTraining(j, fold)
+			})
+		if len(sweepTrain) > 0 {
+			sweep(result, i, fold, distList, distMetrics[m])
+		}
+		var wKclasses []int
+		for _, index := range nearest(distList, *wKmax) {
+			wKclasses = append(wKclasses, classOf(index))
+		}
 
-	for k := *wKmin; k <= *wKmax; k += *wKstep {
-		n := fmt.Sprintf("k%s-", strconv.Itoa(k))
-		result[n+"wf"] = getResult(getkNNClass(wKclasses, trueclass, k), trueclass)
+		for k := *wKmin; k <= *wKmax; k += *wKstep {
+			result[attackName(k, distMetrics[m])] =
+				getResult(getkNNClass(wKclasses, trueclass, k), trueclass)
+		}
+
+		// the same attack on prefixes of the test trace
+		for _, p := range prefixes {
+			wKclasses = classifyFeatures(p.feat, feat, openfeat,
+				globalWeights[m], distMetrics[m], *wKmax, fold, nil)
+			for k := *wKmin; k <= *wKmax; k += *wKstep {
+				result[attackName(k, distMetrics[m])+"@"+p.label] =
+					getResult(getkNNClass(wKclasses, trueclass, k), trueclass)
+			}
+		}
 	}
 
 	return
 }
+
+// readPrefixes reads a cell trace and extracts normalized features of its
+// prefixes, as it streams in and truncated to prefixSpecs.
+func readPrefixes(filename string, s *scaler) (prefixes []prefix) {
+	times, sizes, err := readTrace(filename)
+	if err != nil {
+		log.Fatalf("failed to read trace (%s)", err)
+	}
+	if streaming() {
+		prefixes = streamPrefixes(times, sizes, *streamCells, *streamTime, *streamPoints)
+	}
+	truncated, err := truncatedPrefixes(times, sizes, prefixSpecs)
+	if err != nil {
+		log.Fatalf("failed to extract prefixes of %s (%s)", filename, err)
+	}
+	prefixes = append(prefixes, truncated...)
+	for i := 0; i < len(prefixes); i++ {
+		prefixes[i].feat = s.transform(prefixes[i].feat)
+	}
+	return
+}
@@ -6,6 +6,9 @@ import (
 	"io/ioutil"
 	"log"
 	"math"
+	"path"
+	"strconv"
+	"strings"
 )
 
 func addResult(base, result *metrics) {
@@ -42,10 +45,40 @@ func getResult(output, trueclass int) (m metrics) {
 	return
 }
 
+// classOf returns the class of an instance, indexed with monitored instances
+// first, where the last class represents all open-world sites.
+func classOf(i int) int {
+	class := i / *instances
+	if class > *sites {
+		class = *sites
+	}
+	return class
+}
+
+// features are the features of instance i, monitored or open world.
+func features(i int, feat, openfeat [][]float64) []float64 {
+	if i < len(feat) {
+		return feat[i]
+	}
+	return openfeat[i-len(feat)]
+}
+
+// instanceForTesting is true if instance i (monitored first, then open
+// world) is in the testing fold of the split.
 func instanceForTesting(i, fold int) bool {
-	foldSize := *instances / *folds
-	// the instances at [fold*foldSize,(fold+1)*foldSize) are for testing
-	return i%*instances >= fold*foldSize && i%*instances < (fold+1)*foldSize
+	if split == nil {
+		return contiguousSplit{k: *folds}.Testing(i, fold)
+	}
+	return split.Testing(i, fold)
+}
+
+// instanceForTraining is true if instance i is in the training fold of the
+// split, usually if not for testing.
+func instanceForTraining(i, fold int) bool {
+	if split == nil {
+		return !instanceForTesting(i, fold)
+	}
+	return split.Training(i, fold)
 }
 
 func getMaxInt(f []int) (val int, index int) {
@@ -122,6 +155,11 @@ func accuracy(data []metrics) float64 {
 	return p / float64(len(data))
 }
 
+// outputName is the name of an output file of the run, in the output folder.
+func outputName(suffix string) string {
+	return path.Join(*outDir, fmt.Sprintf("%dx%d+%d%s", *sites, *instances, *open, suffix))
+}
+
 func writeFile(results, name string) {
 	err := ioutil.WriteFile(name, []byte(results), 0666)
 	if err != nil {
@@ -176,3 +214,35 @@ func str2buf(s string, buf *bytes.Buffer) {
 		log.Fatalf("failed to write string (%s)", err)
 	}
 }
+
+// formatStat formats an optional statistic for CSV, where NaN is left empty.
+func formatStat(v float64) string {
+	if math.IsNaN(v) {
+		return ""
+	}
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// parseFloatList parses a comma-separated list of floats.
+func parseFloatList(list string) (values []float64, err error) {
+	for _, v := range strings.Split(list, ",") {
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, f)
+	}
+	return
+}
+
+// parseIntList parses a comma-separated list of integers.
+func parseIntList(list string) (values []int, err error) {
+	for _, v := range strings.Split(list, ",") {
+		i, err := strconv.Atoi(strings.TrimSpace(v))
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, i)
+	}
+	return
+}
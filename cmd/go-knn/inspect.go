@@ -0,0 +1,435 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// inspectMain is the inspect subcommand: describe a model file or check the
+// feature files and cell traces in a dataset folder.
+func inspectMain(args []string) {
+	fs := newFlagSet("inspect", "dataset")
+	reportFile := fs.String("report", "", "file to write the dataset report to (JSON)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageError(fs, "need to specify a model file or data dir")
+	}
+	name := fs.Arg(0)
+	info, err := os.Stat(name)
+	if err != nil {
+		log.Fatalf("failed to inspect %s (%s)", name, err)
+	}
+	if info.IsDir() {
+		inspectDataset(name, *reportFile)
+		return
+	}
+	mf, err := loadModel(name)
+	if err != nil {
+		log.Fatalf("failed to load model (%s)", err)
+	}
+	inspectModel(mf)
+}
+
+func inspectModel(mf *modelFile) {
+	fmt.Printf("model version %d, feature set %s (%d features), created %s\n",
+		mf.Version, mf.FeatureSet, mf.FeatNum, mf.Created)
+	fmt.Printf("dataset %dx%d+%d (roffset %d), %d folds\n",
+		mf.Sites, mf.Instances, mf.Open, mf.ROffset, mf.Folds)
+	fmt.Printf("k from %d to %d (step %d), %s voting\n", mf.KMin, mf.KMax, mf.KStep, mf.Voting)
+	for _, w := range mf.Works {
+		embedded := 0
+		for _, ref := range w.Instances {
+			if ref.Features != nil {
+				embedded++
+			}
+		}
+		fmt.Printf("work %q in %s: %d instances (%d embedded), %d folds\n",
+			w.Name, w.Dir, len(w.Instances), embedded, len(w.Folds))
+		for _, f := range w.Folds {
+			var names []string
+			for _, m := range f.Metrics {
+				names = append(names, m.Metric)
+			}
+			fmt.Printf("\tfold %d: norm %s, %d training instances, metrics %s\n",
+				f.Fold, f.scaler().Method, len(f.Training), strings.Join(names, ","))
+		}
+	}
+}
+
+// validateMain is the validate subcommand: check a dataset folder as inspect
+// does, failing if there are problems.
+func validateMain(args []string) {
+	fs := newFlagSet("validate", "dataset")
+	reportFile := fs.String("report", "", "file to write the dataset report to (JSON)")
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		usageError(fs, "need to specify data dir")
+	}
+	if r := inspectDataset(fs.Arg(0), *reportFile); r.Problems > 0 {
+		os.Exit(1)
+	}
+}
+
+// datasetReport is what inspect finds in a dataset folder.
+type datasetReport struct {
+	Root  string        `json:"root"`
+	Works []*workReport `json:"works"`
+	// Problems is the number of problems in all works.
+	Problems int `json:"problems"`
+}
+
+// workReport is what inspect finds in a work: the instances of each site and
+// the problems with its files.
+type workReport struct {
+	Work  string                `json:"work"`
+	Sites map[string]*siteCount `json:"sites"`
+	// Other is the number of files that are neither features nor traces.
+	Other int `json:"other"`
+	// Missing are the feature files of the dataset given by the dataset
+	// flags that do not exist.
+	Missing           []string      `json:"missing,omitempty"`
+	MissingOpen       int           `json:"missingOpen,omitempty"`
+	Malformed         []fileProblem `json:"malformed,omitempty"`
+	WrongFeatureCount []fileProblem `json:"wrongFeatureCount,omitempty"`
+	EmptyTraces       []string      `json:"emptyTraces,omitempty"`
+	DuplicateTraces   [][]string    `json:"duplicateTraces,omitempty"`
+	DuplicateFeatures [][]string    `json:"duplicateFeatures,omitempty"`
+	// NaN and Inf count feature values go-knn reads as missing (-1), in
+	// NaNInfFiles files.
+	NaN         int `json:"nan"`
+	Inf         int `json:"inf"`
+	NaNInfFiles int `json:"nanInfFiles"`
+}
+
+// siteCount is the number of feature files and traces of a site.
+type siteCount struct {
+	Features int `json:"features"`
+	Traces   int `json:"traces"`
+}
+
+type fileProblem struct {
+	File    string `json:"file"`
+	Problem string `json:"problem"`
+}
+
+// problems is the number of problems in a work, where each duplicate beyond
+// the first counts.
+func (w *workReport) problems() int {
+	n := len(w.Missing) + w.MissingOpen + len(w.Malformed) + len(w.WrongFeatureCount) +
+		len(w.EmptyTraces)
+	for _, groups := range [][][]string{w.DuplicateTraces, w.DuplicateFeatures} {
+		for _, g := range groups {
+			n += len(g) - 1
+		}
+	}
+	return n
+}
+
+func (w *workReport) site(label string) *siteCount {
+	if w.Sites[label] == nil {
+		w.Sites[label] = new(siteCount)
+	}
+	return w.Sites[label]
+}
+
+// inspectDataset checks the works of a dataset folder (by the manifest, if
+// any), prints what it finds, and writes the report if reportFile is set.
+func inspectDataset(root, reportFile string) *datasetReport {
+	r := &datasetReport{Root: root}
+	for _, work := range datasetWorks(root) {
+		w := inspectWork(root, work)
+		r.Works = append(r.Works, w)
+		r.Problems += w.problems()
+		printWork(w)
+	}
+	fmt.Printf("%s: %d works, %d problems\n", root, len(r.Works), r.Problems)
+
+	if reportFile != "" {
+		data, err := json.MarshalIndent(r, "", "  ")
+		if err != nil {
+			log.Fatalf("failed to encode report (%s)", err)
+		}
+		writeFile(string(data)+"\n", reportFile)
+	}
+	return r
+}
+
+// datasetWorks loads the manifest, if set, and returns the works of a dataset
+// folder: those of the manifest or the subfolders, otherwise "" for the
+// folder itself.
+func datasetWorks(root string) (works []string) {
+	if *manifestFile != "" {
+		var err error
+		if manifest, err = loadManifest(*manifestFile); err != nil {
+			log.Fatalf("failed to load manifest (%s)", err)
+		}
+		works = manifest.works()
+	} else {
+		dir, err := ioutil.ReadDir(root)
+		if err != nil {
+			log.Fatalf("failed to read data dir (%s)", err)
+		}
+		for _, f := range dir {
+			if f.IsDir() {
+				works = append(works, f.Name())
+			}
+		}
+	}
+	if len(works) == 0 {
+		works = append(works, "")
+	}
+	return
+}
+
+// inspectWork checks the feature files and traces of a work.
+func inspectWork(root, work string) *workReport {
+	w := &workReport{Work: work, Sites: make(map[string]*siteCount)}
+	dir := path.Join(root, work)
+
+	// the feature files and traces of the work, relative to dir
+	var features, traces []string
+	if manifest != nil {
+		dir = root
+		for _, e := range manifest.Entries {
+			if e.Work != work {
+				continue
+			}
+			if _, err := os.Stat(path.Join(dir, e.Path)); err != nil {
+				w.Missing = append(w.Missing, e.Path)
+				continue
+			}
+			features = append(features, e.Path)
+			w.site(e.Site).Features++
+			if _, err := os.Stat(traceFile(dir, e.Path)); err == nil {
+				traces = append(traces, strings.TrimSuffix(e.Path, FeatureSuffix))
+				w.site(e.Site).Traces++
+			}
+		}
+	} else {
+		files, err := ioutil.ReadDir(dir)
+		if err != nil {
+			log.Fatalf("failed to read work %s (%s)", dir, err)
+		}
+		for _, f := range files {
+			name := f.Name()
+			if f.IsDir() {
+				continue
+			}
+			index := strings.Index(name, "-")
+			if index == -1 {
+				w.Other++
+				continue
+			}
+			if strings.HasSuffix(name, FeatureSuffix) {
+				features = append(features, name)
+				w.site(name[:index]).Features++
+			} else if !strings.Contains(name, ".") { // cell traces have no extension
+				traces = append(traces, name)
+				w.site(name[:index]).Traces++
+			} else {
+				w.Other++
+			}
+		}
+		w.expect(dir)
+	}
+
+	featureHashes, traceHashes := make(map[string][]string), make(map[string][]string)
+	for _, f := range features {
+		data, err := ioutil.ReadFile(path.Join(dir, f))
+		if err != nil {
+			w.Malformed = append(w.Malformed, fileProblem{f, err.Error()})
+			continue
+		}
+		n, nan, inf, err := checkFeatures(string(data))
+		if err != nil {
+			w.Malformed = append(w.Malformed, fileProblem{f, err.Error()})
+			continue
+		}
+		if n != FeatNum {
+			w.WrongFeatureCount = append(w.WrongFeatureCount,
+				fileProblem{f, fmt.Sprintf("%d features, expected %d", n, FeatNum)})
+		}
+		w.NaN, w.Inf = w.NaN+nan, w.Inf+inf
+		if nan+inf > 0 {
+			w.NaNInfFiles++
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(data))
+		featureHashes[hash] = append(featureHashes[hash], f)
+	}
+	for _, t := range traces {
+		times, _, err := readTrace(path.Join(dir, t))
+		if err != nil {
+			w.Malformed = append(w.Malformed, fileProblem{t, err.Error()})
+			continue
+		}
+		if len(times) == 0 {
+			w.EmptyTraces = append(w.EmptyTraces, t)
+			continue
+		}
+		data, err := ioutil.ReadFile(path.Join(dir, t))
+		if err != nil {
+			w.Malformed = append(w.Malformed, fileProblem{t, err.Error()})
+			continue
+		}
+		hash := fmt.Sprintf("%x", sha256.Sum256(data))
+		traceHashes[hash] = append(traceHashes[hash], t)
+	}
+	w.DuplicateFeatures = duplicates(featureHashes)
+	w.DuplicateTraces = duplicates(traceHashes)
+	return w
+}
+
+// expect finds the feature files missing for the dataset flags, if given, in
+// go-knn's layout: the instances of the monitored sites and enough
+// unmonitored ones.
+func (w *workReport) expect(dir string) {
+	if *sites == 0 || *instances == 0 {
+		return
+	}
+	for site := *roffset + 1; site <= *roffset+*sites; site++ {
+		for i := 0; i < *instances; i++ {
+			name := strconv.Itoa(site) + "-" + strconv.Itoa(i) + FeatureSuffix
+			if _, err := os.Stat(path.Join(dir, name)); err != nil {
+				w.Missing = append(w.Missing, name)
+			}
+		}
+	}
+	available := 0
+	for label, c := range w.Sites {
+		site, err := strconv.Atoi(label)
+		if err != nil || (site > *roffset && site <= *roffset+*sites) {
+			continue
+		}
+		if c.Features > *openInstances {
+			available += *openInstances
+		} else {
+			available += c.Features
+		}
+	}
+	if available < *open {
+		w.MissingOpen = *open - available
+	}
+}
+
+// checkFeatures parses features as parseFeatures does, counting the features
+// and the NaN and Inf values among them.
+func checkFeatures(features string) (n, nan, inf int, err error) {
+	for i, f := range strings.Split(features, FeatureDelimiter) {
+		if f == "'X'" {
+			n++
+		} else if f != "" {
+			val, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				return 0, 0, 0, fmt.Errorf("bad feature %d (%s)", i+1, err)
+			}
+			if math.IsNaN(val) {
+				nan++
+			} else if math.IsInf(val, 0) {
+				inf++
+			}
+			n++
+		}
+	}
+	return
+}
+
+// duplicates are the groups of files with the same hash, sorted.
+func duplicates(hashes map[string][]string) (groups [][]string) {
+	for _, files := range hashes {
+		if len(files) > 1 {
+			sort.Strings(files)
+			groups = append(groups, files)
+		}
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return
+}
+
+// printWork prints the instances per site and the problems of a work.
+func printWork(w *workReport) {
+	name := w.Work
+	if name == "" {
+		name = "."
+	}
+	fmt.Printf("work %s: %d sites, %d other files\n", name, len(w.Sites), w.Other)
+	for _, kind := range []struct {
+		name  string
+		count func(c *siteCount) int
+	}{{"feature files", func(c *siteCount) int { return c.Features }},
+		{"cell traces", func(c *siteCount) int { return c.Traces }}} {
+		// number of sites with each instance count
+		total, sitesWith, perCount := 0, 0, make(map[int]int)
+		for _, c := range w.Sites {
+			if n := kind.count(c); n > 0 {
+				total += n
+				sitesWith++
+				perCount[n]++
+			}
+		}
+		if total == 0 {
+			fmt.Printf("\tno %s\n", kind.name)
+			continue
+		}
+		var instanceCounts []int
+		for n := range perCount {
+			instanceCounts = append(instanceCounts, n)
+		}
+		sort.Ints(instanceCounts)
+		fmt.Printf("\t%d %s of %d sites\n", total, kind.name, sitesWith)
+		for _, n := range instanceCounts {
+			fmt.Printf("\t\t%d sites with %d instances\n", perCount[n], n)
+		}
+	}
+	if w.NaN+w.Inf > 0 {
+		fmt.Printf("\t%d NaN and %d Inf feature values (read as missing) in %d files\n",
+			w.NaN, w.Inf, w.NaNInfFiles)
+	}
+
+	// problems, the first few of each kind
+	list := func(kind string, files []string) {
+		if len(files) == 0 {
+			return
+		}
+		fmt.Printf("\t%d %s:", len(files), kind)
+		for i, f := range files {
+			if i == 5 {
+				fmt.Printf(" ... (%d more)", len(files)-i)
+				break
+			}
+			fmt.Printf(" %s", f)
+		}
+		fmt.Println()
+	}
+	problems := func(kind string, ps []fileProblem) {
+		var files []string
+		for _, p := range ps {
+			files = append(files, p.File+" ("+p.Problem+")")
+		}
+		list(kind, files)
+	}
+	groups := func(kind string, gs [][]string) {
+		var files []string
+		for _, g := range gs {
+			files = append(files, strings.Join(g, "="))
+		}
+		list(kind, files)
+	}
+	list("missing feature files", w.Missing)
+	if w.MissingOpen > 0 {
+		fmt.Printf("\t%d open-world instances missing\n", w.MissingOpen)
+	}
+	problems("malformed files", w.Malformed)
+	problems("feature files with a wrong feature count", w.WrongFeatureCount)
+	list("empty traces", w.EmptyTraces)
+	groups("groups of identical traces", w.DuplicateTraces)
+	groups("groups of identical feature files", w.DuplicateFeatures)
+}
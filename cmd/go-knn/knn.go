@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"math"
@@ -12,15 +14,6 @@ import (
 
 type ignoreSite func(int) bool
 
-func dist(from, to, weight []float64, presentFromFeat []int) (d float64) {
-	for _, i := range presentFromFeat {
-		if to[i] != -1 { // also present to?
-			d += weight[i] * math.Abs(from[i]-to[i])
-		}
-	}
-	return
-}
-
 func getMin(f []float64) (val float64, index int) {
 	index = 0
 	val = f[0]
@@ -33,7 +26,9 @@ func getMin(f []float64) (val float64, index int) {
 	return
 }
 
-func readFeatures(root string) (feat, openfeat [][]float64) {
+// readFeatures reads the features of all monitored and open-world instances in
+// root, also returning their file names (monitored first, then open world).
+func readFeatures(root string) (feat, openfeat [][]float64, files []string) {
 	// flag all sites we read
 	done := make(map[int]bool)
 
@@ -41,92 +36,207 @@ func readFeatures(root string) (feat, openfeat [][]float64) {
 	for i := 0; i < *sites; i++ {
 		site := *roffset + i + 1
 		for j := 0; j < *instances; j++ {
-			feat = append(feat,
-				read(path.Join(root, strconv.Itoa(site)+"-"+strconv.Itoa(j)+FeatureSuffix)))
+			name := strconv.Itoa(site) + "-" + strconv.Itoa(j) + FeatureSuffix
+			feat = append(feat, read(path.Join(root, name)))
+			files = append(files, name)
 		}
 		done[site] = true
 	}
 
-	// open sites, attempt to read *unmonitored number of sites from the
-	// folder that we didn't already read
-	files, err := ioutil.ReadDir(root)
+	// open sites, attempt to read *open instances of sites from the folder
+	// that we didn't already read, up to *openInstances of each site
+	dir, err := ioutil.ReadDir(root)
 	if err != nil {
 		log.Fatalf("failed to read unmonitored folder (%s)", err)
 	}
-	for i := 0; i < len(files); i++ {
+	taken := make(map[int]int)
+	for i := 0; i < len(dir) && len(openfeat) < *open; i++ {
 		// read site
-		index := strings.Index(files[i].Name(), "-")
-		if index == -1 || files[i].IsDir() {
+		index := strings.Index(dir[i].Name(), "-")
+		if index == -1 || dir[i].IsDir() || !strings.HasSuffix(dir[i].Name(), FeatureSuffix) {
 			continue
 		}
-		s, err := strconv.Atoi(files[i].Name()[:index])
+		s, err := strconv.Atoi(dir[i].Name()[:index])
 		if err != nil {
 			continue
 		}
 
-		_, taken := done[s]
-		if !taken {
+		if !done[s] && taken[s] < *openInstances {
 			openfeat = append(openfeat,
-				read(path.Join(root, files[i].Name())))
-			done[s] = true
+				read(path.Join(root, dir[i].Name())))
+			files = append(files, dir[i].Name())
+			taken[s]++
 		}
-		if len(done) >= *sites+*open {
-			break
-		}
-		// break if done done
 	}
 
-	if len(done) < *sites+*open {
-		log.Fatalf("failed to read %d open world sites", *open)
+	if len(openfeat) < *open {
+		log.Fatalf("failed to read %d open world instances (found %d of %d sites)",
+			*open, len(openfeat), len(taken))
 	}
 
 	return
 }
 
 func read(filename string) (feat []float64) {
-	d, err := ioutil.ReadFile(filename)
+	feat, err := readFeatureFile(filename)
 	if err != nil {
 		log.Fatalf("failed to find file to read features for filename %s (%s)", filename, err)
 	}
+	return
+}
 
-	// extract features
-	for _, f := range strings.Split(string(d), " ") {
+func readFeatureFile(filename string) ([]float64, error) {
+	d, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	feat, err := parseFeatures(string(d))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %s", filename, err)
+	}
+	return feat, nil
+}
+
+// parseFeatures parses features as written by the feature extractor.
+func parseFeatures(features string) (feat []float64, err error) {
+	for i, f := range strings.Split(features, " ") {
 		if f == "'X'" {
 			feat = append(feat, -1)
 		} else if f != "" {
-			feat = append(feat, parseFeatureString(f))
+			val, err := parseFeatureString(f)
+			if err != nil {
+				return nil, fmt.Errorf("bad feature %d (%s)", i+1, err)
+			}
+			feat = append(feat, val)
 		}
 	}
 	return
 }
 
-func parseFeatureString(c string) float64 {
+func parseFeatureString(c string) (float64, error) {
 	val, err := strconv.ParseFloat(c, 64)
 	if err != nil {
-		panic(err)
+		return 0, err
 	}
 	if math.IsNaN(val) || math.IsInf(val, 1) || math.IsInf(val, 0) {
 		// data is messy
-		return -1
+		return -1, nil
+	}
+	return val, nil
+}
+
+// roundStats are statistics of one round of WLLCC, to track convergence.
+type roundStats struct {
+	round        int
+	badInRadius  int     // bad neighbours within the good radius (N_bad)
+	weightChange float64 // L2 norm of the change of the weight vector
+	heldOut      float64 // accuracy on the held-out slice, NaN if not evaluated
+}
+
+// wllccParams are the hyperparameters of WLLCC weight learning.
+type wllccParams struct {
+	rate             float64 // learning rate
+	reco             int     // number of good and bad neighbours
+	initMin, initMax float64 // range of the random initial weights
+}
+
+// holdOut selects a random slice of the training instances of a fold that are
+// not in the optional exclude, per site for the monitored instances, to
+// evaluate weights on. The returned slice is indexed by instance, first
+// monitored then open.
+func holdOut(feat, openfeat [][]float64, fold int, fraction float64,
+	exclude []bool) (heldOut []bool) {
+	heldOut = make([]bool, len(feat)+len(openfeat))
+	pick := func(candidates []int) {
+		n := int(fraction * float64(len(candidates)))
+		if n >= len(candidates) {
+			n = len(candidates) - 1 // always leave something to learn from
+		}
+		if n < 0 {
+			n = 0
+		}
+		for _, c := range rand.Perm(len(candidates))[:n] {
+			heldOut[candidates[c]] = true
+		}
+	}
+
+	for site := 0; site < *sites; site++ {
+		var candidates []int
+		for j := site * *instances; j < (site+1)**instances; j++ {
+			if instanceForTraining(j, fold) && (exclude == nil || !exclude[j]) {
+				candidates = append(candidates, j)
+			}
+		}
+		pick(candidates)
+	}
+	var candidates []int
+	for j := 0; j < len(openfeat); j++ {
+		if instanceForTraining(len(feat)+j, fold) && (exclude == nil || !exclude[len(feat)+j]) {
+			candidates = append(candidates, len(feat)+j)
+		}
+	}
+	pick(candidates)
+
+	return
+}
+
+// heldOutAccuracy is the fraction of held-out instances that Wa-kNN with
+// wKmin neighbours classifies correctly, using the training instances that
+// are not in exclude (which should include the held-out instances).
+func heldOutAccuracy(feat, openfeat [][]float64, weight []float64, m Metric,
+	fold int, heldOut, exclude []bool) float64 {
+	var correct, total int
+	for i := 0; i < len(heldOut); i++ {
+		if !heldOut[i] {
+			continue
+		}
+		classes, trueclass := classify(i, feat, openfeat, weight, m,
+			*wKmin, fold, exclude)
+		if getkNNClass(classes, trueclass, *wKmin) == trueclass {
+			correct++
+		}
+		total++
+	}
+	if total == 0 {
+		return math.NaN()
 	}
-	return val
+	return float64(correct) / float64(total)
 }
 
-func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
+// wllcc learns weights for metric m on the training instances of a fold,
+// except those marked in the optional exclude (indexed as in holdOut). If ctx
+// is cancelled, wllcc stops early with the weights learned so far.
+func wllcc(ctx context.Context, feat, openfeat [][]float64, fold int, m Metric,
+	p wllccParams, exclude []bool) (weight []float64, stats []roundStats) {
 	weight = make([]float64, FeatNum)
-	// start with random weights between [0.5, 1.5]
+	// start with random weights between [initMin, initMax], by default [0.5, 1.5]
 	for i := 0; i < FeatNum; i++ {
-		weight[i] = rand.Float64() + 0.5
+		weight[i] = p.initMin + rand.Float64()*(p.initMax-p.initMin)
+	}
+	prevWeight := make([]float64, FeatNum)
+
+	// early stopping: learn on all but a held-out slice of the training fold,
+	// keeping the weights that did best on the held-out slice
+	heldOut := make([]bool, len(feat)+len(openfeat))
+	var bestWeight []float64
+	bestAcc, sinceBest := math.Inf(-1), 0
+	if *earlyStop > 0 {
+		heldOut = holdOut(feat, openfeat, fold, *earlyHoldout, exclude)
+	}
+	// the instances we neither learn from nor evaluate on
+	ignored := make([]bool, len(feat)+len(openfeat))
+	for j := 0; j < len(ignored); j++ {
+		ignored[j] = heldOut[j] || (exclude != nil && exclude[j])
 	}
 
 	distList := make([]float64, len(feat)+len(openfeat))
-	recoGoodList := make([]int, RecoPointsNum)
-	recoBadList := make([]int, RecoPointsNum)
+	recoGoodList := make([]int, p.reco)
+	recoBadList := make([]int, p.reco)
 
 	var ctr int
 	sitePerm := rand.Perm(*sites) // random permutation of all sites
 	// perform WeightRounds number of rounds of weight learning
-	for round := 0; round < *weightRounds; round++ {
+	for round := 0; round < *weightRounds && ctx.Err() == nil; round++ {
 		// i is the instance of a monitored site used for distance calculations
 		var i int
 		for {
@@ -134,7 +244,7 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 			// instances of the same site
 			i = sitePerm[ctr%(len(sitePerm))]**instances + rand.Intn(*instances)
 			ctr++
-			if !instanceForTesting(i, fold) {
+			if instanceForTraining(i, fold) && !ignored[i] {
 				break // only learn on training instances
 			}
 		}
@@ -151,30 +261,34 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 			}
 		}
 
-		// calculate the distance to every other monitored instance
-		for j := 0; j < len(feat); j++ {
-			if instanceForTesting(j, fold) {
-				distList[j] = math.MaxFloat64
-			} else {
-				distList[j] = dist(feat[i], feat[j], weight, presentFeat)
-			}
-		}
-		// and the distance to all open sites
-		for j := 0; j < len(openfeat); j++ {
-			if instanceForTesting(j, fold) {
-				distList[len(feat)+j] = math.MaxFloat64
-			} else {
-				distList[len(feat)+j] = dist(feat[i], openfeat[j], weight, presentFeat)
+		// calculate the distance to every other monitored instance and all
+		// open sites, in parallel if there are free threads
+		parallel(len(distList), func(from, to int) {
+			for j := from; j < to; j++ {
+				other, index := feat, j
+				if j >= len(feat) {
+					other, index = openfeat, j-len(feat)
+				}
+				if !instanceForTraining(j, fold) || ignored[j] {
+					distList[j] = math.MaxFloat64
+				} else {
+					distList[j] = m.Dist(feat[i], other[index], weight, presentFeat)
+				}
 			}
-		}
+		})
 
 		/*
 			weight recommendation
 		*/
 		var maxGoodDist float64
-		// S_good = recoGoodList
-		for j := 0; j < RecoPointsNum; j++ {
-			_, minIndex := getMin(distList[curSite**instances : (curSite+1)**instances])
+		// S_good = goodList, fewer than reco if the site has fewer training
+		// instances (that are not ignored)
+		goodList := recoGoodList[:0]
+		for j := 0; j < p.reco; j++ {
+			minDist, minIndex := getMin(distList[curSite**instances : (curSite+1)**instances])
+			if minDist == math.MaxFloat64 {
+				break // only testing or ignored instances left
+			}
 			// we have to add the off-set in the index above
 			minIndex += curSite * *instances
 
@@ -184,7 +298,7 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 
 			// don't select the same instance again
 			distList[minIndex] = math.MaxFloat64
-			recoGoodList[j] = minIndex
+			goodList = append(goodList, minIndex)
 		}
 
 		// don't consider any instances for the current site in the future
@@ -193,7 +307,7 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 		}
 
 		// S_bad = recoBadList
-		for j := 0; j < RecoPointsNum; j++ {
+		for j := 0; j < p.reco; j++ {
 			_, minIndex := getMin(distList)
 			// don't select the same instance again
 			distList[minIndex] = math.MaxFloat64
@@ -208,9 +322,9 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 
 			// calculate maxgood for the feature (d_{f_i})
 			var maxGood float64
-			for k := 0; k < RecoPointsNum; k++ {
-				n := math.Abs(feat[i][j] - feat[recoGoodList[k]][j])
-				if feat[i][j] == -1 || feat[recoGoodList[k]][j] == -1 {
+			for _, good := range goodList {
+				n := math.Abs(feat[i][j] - feat[good][j])
+				if feat[i][j] == -1 || feat[good][j] == -1 {
 					n = 0
 				}
 				if n >= maxGood {
@@ -219,7 +333,7 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 			}
 
 			// count bad distances (n_{bad_i})
-			for k := 0; k < RecoPointsNum; k++ {
+			for k := 0; k < p.reco; k++ {
 				var n float64
 				if recoBadList[k] < len(feat) {
 					// monitored
@@ -253,13 +367,13 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 		*/
 		// find out how poorly the current point is classified
 		var distCountBad int
-		for j := 0; j < RecoPointsNum; j++ {
+		for j := 0; j < p.reco; j++ {
 			if recoBadList[j] < len(feat) &&
-				dist(feat[i], feat[recoBadList[j]],
+				m.Dist(feat[i], feat[recoBadList[j]],
 					weight, presentFeat) <= maxGoodDist {
 				distCountBad++
 			} else if recoBadList[j] >= len(feat) &&
-				dist(feat[i], openfeat[recoBadList[j]-len(feat)],
+				m.Dist(feat[i], openfeat[recoBadList[j]-len(feat)],
 					weight, presentFeat) <= maxGoodDist {
 				distCountBad++
 			}
@@ -268,27 +382,76 @@ func wllcc(feat, openfeat [][]float64, fold int) (weight []float64) {
 		for j := 0; j < FeatNum; j++ {
 			// only adjust weight for non-min countBad features
 			if badList[j] != minBadList {
-				// reduce by weight * 0.01 * (n_{bad_i} / reco) * (1 + N_bad) / reco
-				weight[j] -= weight[j] * 0.01 * (float64(badList[j]) / float64(RecoPointsNum)) * float64(1+distCountBad) / float64(RecoPointsNum)
+				// reduce by weight * rate * (n_{bad_i} / reco) * (1 + N_bad) / reco
+				weight[j] -= weight[j] * p.rate * (float64(badList[j]) / float64(p.reco)) * float64(1+distCountBad) / float64(p.reco)
 			}
 			// increase all weights by min(n_bad)
 			weight[j] += float64(minBadList)
 		}
+
+		/*
+			convergence tracking and early stopping
+		*/
+		var change float64
+		for j := 0; j < FeatNum; j++ {
+			change += (weight[j] - prevWeight[j]) * (weight[j] - prevWeight[j])
+			prevWeight[j] = weight[j]
+		}
+		s := roundStats{
+			round:        round,
+			badInRadius:  distCountBad,
+			weightChange: math.Sqrt(change),
+			heldOut:      math.NaN(),
+		}
+		if round == 0 {
+			s.weightChange = math.NaN() // no previous weights to compare with
+		}
+		if *earlyStop > 0 && (round+1)%*earlyEvery == 0 {
+			s.heldOut = heldOutAccuracy(feat, openfeat, weight, m, fold, heldOut, ignored)
+			if s.heldOut > bestAcc {
+				bestAcc, sinceBest = s.heldOut, 0
+				bestWeight = append(bestWeight[:0], weight...)
+			} else {
+				sinceBest++
+			}
+		}
+		stats = append(stats, s)
+		if *earlyStop > 0 && sinceBest >= *earlyStop {
+			break
+		}
 	}
 
+	if bestWeight != nil {
+		weight = bestWeight
+	}
 	return
 }
 
-func classify(test int, feat, openfeat [][]float64, weight []float64,
-	neighbours, fold int) (classes []int, trueClass int) {
-	// support classifying an open-world instance
-	var testfeat []float64
-	if test < len(feat) {
-		testfeat = feat[test]
-	} else {
-		testfeat = openfeat[test-len(feat)]
+// classify finds the classes of the closest neighbours of the test instance
+// among the training instances of the fold, except those marked in the
+// optional exclude (indexed as test).
+func classify(test int, feat, openfeat [][]float64, weight []float64, m Metric,
+	neighbours, fold int, exclude []bool) (classes []int, trueClass int) {
+	return classifyFeatures(features(test, feat, openfeat), feat, openfeat, weight, m, neighbours,
+		fold, exclude), classOf(test)
+}
+
+// classifyFeatures is classify for the features of an instance.
+func classifyFeatures(testfeat []float64, feat, openfeat [][]float64,
+	weight []float64, m Metric, neighbours, fold int, exclude []bool) (classes []int) {
+	distList := distances(testfeat, feat, openfeat, weight, m, func(i int) bool {
+		return !instanceForTraining(i, fold) || (exclude != nil && exclude[i])
+	})
+	for _, index := range nearest(distList, neighbours) {
+		classes = append(classes, classOf(index))
 	}
+	return
+}
 
+// distances calculates the distance from testfeat to all monitored and then
+// all open-world instances, where ignored instances are at math.MaxFloat64.
+func distances(testfeat []float64, feat, openfeat [][]float64, weight []float64,
+	m Metric, ignore ignoreSite) (distList []float64) {
 	// optimization from @fowlslegs: determine present features
 	presentFeat := make([]int, 0, FeatNum)
 	for i := 0; i < FeatNum; i++ {
@@ -297,48 +460,48 @@ func classify(test int, feat, openfeat [][]float64, weight []float64,
 		}
 	}
 
-	distList := make([]float64, len(feat)+len(openfeat))
+	distList = make([]float64, len(feat)+len(openfeat))
 	for i := 0; i < len(feat); i++ {
-		if instanceForTesting(i, fold) {
+		if ignore(i) {
 			distList[i] = math.MaxFloat64
 		} else {
 			// distance to all sites and their instances
-			distList[i] = dist(testfeat, feat[i], weight, presentFeat)
+			distList[i] = m.Dist(testfeat, feat[i], weight, presentFeat)
 		}
 	}
 
 	for i := 0; i < len(openfeat); i++ {
-		if instanceForTesting(i, fold) {
+		if ignore(len(feat) + i) {
 			distList[len(feat)+i] = math.MaxFloat64
 		} else {
 			// distance to all open-world sites
-			distList[len(feat)+i] = dist(testfeat, openfeat[i], weight, presentFeat)
+			distList[len(feat)+i] = m.Dist(testfeat, openfeat[i], weight, presentFeat)
 		}
 	}
 
-	for i := 0; i < neighbours; i++ {
-		_, index := getMin(distList)
-		class := index / *instances
-		if class > *sites {
-			// we use the last class to represent all open-world sites
-			class = *sites
-		}
-		classes = append(classes, class)
+	return
+}
 
+// nearest returns the indices of the n smallest distances, closest first.
+// Note that distList is modified.
+func nearest(distList []float64, n int) (indices []int) {
+	for i := 0; i < n; i++ {
+		_, index := getMin(distList)
+		indices = append(indices, index)
 		distList[index] = math.MaxFloat64
 	}
-
-	trueClass = test / *instances
-	if trueClass > *sites {
-		trueClass = *sites
-	}
-
 	return
 }
 
 func getkNNClass(classes []int, trueclass, k int) (out int) {
+	return vote(classes, k, *sites)
+}
+
+// vote is the Wa-kNN voting rule over the classes of the closest neighbours,
+// where unmonitored is the class representing the open world.
+func vote(classes []int, k, unmonitoredClass int) (out int) {
 	// classifier guesses unmonitored unless k closest classes agree on something
-	out = *sites
+	out = unmonitoredClass
 	unmonitored := false
 	for i := 0; i < k-1; i++ {
 		if classes[i] != classes[i+1] {
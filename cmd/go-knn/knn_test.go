@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHoldOut(t *testing.T) {
+	setFlags(t, map[string]string{"sites": "3", "instances": "10", "folds": "5"})
+	feat := make([][]float64, *sites**instances)
+	for _, open := range []int{0, 1, 8} {
+		setFlags(t, map[string]string{"open": strconv.Itoa(open)})
+		openfeat := make([][]float64, open)
+		heldOut := holdOut(feat, openfeat, 0, 0.5, nil)
+		if len(heldOut) != len(feat)+open {
+			t.Fatalf("open %d: %d held-out flags for %d instances", open, len(heldOut),
+				len(feat)+open)
+		}
+		held := 0
+		for i, h := range heldOut {
+			if h && !instanceForTraining(i, 0) {
+				t.Errorf("open %d: held out instance %d is not training", open, i)
+			}
+			if h && i >= len(feat) && open == 1 {
+				t.Errorf("open 1: held out the only open-world instance")
+			}
+			if h && i < len(feat) {
+				held++
+			}
+		}
+		// half of the 8 training instances of each site
+		if held != 4**sites {
+			t.Errorf("open %d: held out %d monitored instances, want %d", open, held, 4**sites)
+		}
+	}
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// manifestColumns are the columns of a CSV manifest with a meaning to
+// go-knn, any other column is metadata.
+var manifestColumns = []string{"path", "work", "site", "instance", "monitored", "time"}
+
+// manifestEntry is an instance of a dataset.
+type manifestEntry struct {
+	// Path is the file of the instance, relative to the data dir.
+	Path string `json:"path"`
+	// Work groups instances into works, as subfolders do without a manifest.
+	Work      string `json:"work,omitempty"`
+	Site      string `json:"site"`
+	Instance  string `json:"instance,omitempty"`
+	Monitored bool   `json:"monitored"`
+	// Time is when the instance was collected, RFC 3339 or Unix seconds.
+	Time string            `json:"time,omitempty"`
+	Meta map[string]string `json:"meta,omitempty"`
+}
+
+// datasetManifest maps the files of a dataset to sites and instances,
+// instead of go-knn's file names.
+type datasetManifest struct {
+	Entries []manifestEntry
+	byPath  map[string]*manifestEntry
+}
+
+// manifest is the manifest of the dataset, nil to use go-knn's file names.
+var manifest *datasetManifest
+
+// loadManifest reads a manifest from a JSON file with a list of entries, or
+// from a CSV file with a header of at least path, site and monitored.
+func loadManifest(name string) (*datasetManifest, error) {
+	m := new(datasetManifest)
+	if strings.HasSuffix(name, ".json") {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if err = json.Unmarshal(data, &m.Entries); err != nil {
+			return nil, fmt.Errorf("failed to parse manifest %s (%s)", name, err)
+		}
+	} else if err := m.readCSV(name); err != nil {
+		return nil, err
+	}
+	if err := m.index(name); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// index checks the entries of the manifest called name and indexes them by
+// path.
+func (m *datasetManifest) index(name string) error {
+	m.byPath = make(map[string]*manifestEntry)
+	for i := range m.Entries {
+		e := &m.Entries[i]
+		if e.Path == "" || e.Site == "" {
+			return fmt.Errorf("entry %d of manifest %s lacks a path or site", i+1, name)
+		}
+		e.Path = path.Clean(e.Path)
+		if _, exists := m.byPath[e.Path]; exists {
+			return fmt.Errorf("%s is in manifest %s twice", e.Path, name)
+		}
+		m.byPath[e.Path] = e
+	}
+	return nil
+}
+
+func (m *datasetManifest) readCSV(name string) error {
+	file, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	if err != nil {
+		return fmt.Errorf("failed to parse manifest %s (%s)", name, err)
+	}
+	if len(records) == 0 {
+		return fmt.Errorf("manifest %s is empty", name)
+	}
+	column := make(map[string]int)
+	for c, h := range records[0] {
+		column[strings.TrimSpace(h)] = c
+	}
+	for _, required := range []string{"path", "site", "monitored"} {
+		if _, exists := column[required]; !exists {
+			return fmt.Errorf("manifest %s has no %s column", name, required)
+		}
+	}
+	value := func(record []string, key string) string {
+		if c, exists := column[key]; exists {
+			return strings.TrimSpace(record[c])
+		}
+		return ""
+	}
+	for line, record := range records[1:] {
+		e := manifestEntry{
+			Path:     value(record, "path"),
+			Work:     value(record, "work"),
+			Site:     value(record, "site"),
+			Instance: value(record, "instance"),
+			Time:     value(record, "time"),
+		}
+		if e.Monitored, err = strconv.ParseBool(value(record, "monitored")); err != nil {
+			return fmt.Errorf("bad monitored flag in line %d of %s", line+2, name)
+		}
+		for key, c := range column {
+			if !isManifestColumn(key) {
+				if e.Meta == nil {
+					e.Meta = make(map[string]string)
+				}
+				e.Meta[key] = record[c]
+			}
+		}
+		m.Entries = append(m.Entries, e)
+	}
+	return nil
+}
+
+func isManifestColumn(name string) bool {
+	for _, c := range manifestColumns {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// writeManifest writes entries as a CSV manifest, with a column for each
+// metadata key.
+func writeManifest(entries []manifestEntry, name string) error {
+	keys := make(map[string]bool)
+	for _, e := range entries {
+		for key := range e.Meta {
+			keys[key] = true
+		}
+	}
+	var meta []string
+	for key := range keys {
+		meta = append(meta, key)
+	}
+	sort.Strings(meta)
+
+	file, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(file)
+	w.Write(append(append([]string(nil), manifestColumns...), meta...))
+	for _, e := range entries {
+		record := []string{e.Path, e.Work, e.Site, e.Instance,
+			strconv.FormatBool(e.Monitored), e.Time}
+		for _, key := range meta {
+			record = append(record, e.Meta[key])
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err = w.Error(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// works are the works of the manifest, sorted, nil if it has none.
+func (m *datasetManifest) works() (works []string) {
+	seen := make(map[string]bool)
+	for _, e := range m.Entries {
+		if e.Work != "" && !seen[e.Work] {
+			seen[e.Work] = true
+			works = append(works, e.Work)
+		}
+	}
+	sort.Strings(works)
+	return
+}
+
+// labelLess orders site labels and instance ids, numerically if both are
+// numbers.
+func labelLess(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
+
+// readManifestFeatures is readFeatures for the instances of a work in the
+// manifest, with paths relative to root: the first instances of the
+// monitored sites after roffset (in label order), then the first instances
+// of the unmonitored sites.
+func readManifestFeatures(root, work string) (feat, openfeat [][]float64, files []string, err error) {
+	monitored := make(map[string][]*manifestEntry)
+	unmonitored := make(map[string][]*manifestEntry)
+	var monitoredSites, unmonitoredSites []string
+	hasWorks := len(manifest.works()) > 0
+	for i := range manifest.Entries {
+		e := &manifest.Entries[i]
+		if hasWorks && e.Work != work {
+			continue
+		}
+		if e.Monitored {
+			if monitored[e.Site] == nil {
+				monitoredSites = append(monitoredSites, e.Site)
+			}
+			monitored[e.Site] = append(monitored[e.Site], e)
+		} else {
+			if unmonitored[e.Site] == nil {
+				unmonitoredSites = append(unmonitoredSites, e.Site)
+			}
+			unmonitored[e.Site] = append(unmonitored[e.Site], e)
+		}
+	}
+	sort.SliceStable(monitoredSites, func(i, j int) bool {
+		return labelLess(monitoredSites[i], monitoredSites[j])
+	})
+	sort.SliceStable(unmonitoredSites, func(i, j int) bool {
+		return labelLess(unmonitoredSites[i], unmonitoredSites[j])
+	})
+	byInstance := func(entries []*manifestEntry) {
+		sort.SliceStable(entries, func(i, j int) bool {
+			return labelLess(entries[i].Instance, entries[j].Instance)
+		})
+	}
+
+	if len(monitoredSites) < *roffset+*sites {
+		return nil, nil, nil, fmt.Errorf("manifest has %d monitored sites, need %d",
+			len(monitoredSites), *roffset+*sites)
+	}
+	add := func(e *manifestEntry, to *[][]float64) error {
+		f, err := readFeatureFile(path.Join(root, e.Path))
+		if err != nil {
+			return err
+		}
+		*to = append(*to, f)
+		files = append(files, e.Path)
+		return nil
+	}
+	for _, site := range monitoredSites[*roffset : *roffset+*sites] {
+		entries := monitored[site]
+		if len(entries) < *instances {
+			return nil, nil, nil, fmt.Errorf("manifest has %d instances of site %s, need %d",
+				len(entries), site, *instances)
+		}
+		byInstance(entries)
+		for _, e := range entries[:*instances] {
+			if err = add(e, &feat); err != nil {
+				return
+			}
+		}
+	}
+	for _, site := range unmonitoredSites {
+		entries := unmonitored[site]
+		byInstance(entries)
+		for i := 0; i < len(entries) && i < *openInstances && len(openfeat) < *open; i++ {
+			if err = add(entries[i], &openfeat); err != nil {
+				return
+			}
+		}
+	}
+	if len(openfeat) < *open {
+		return nil, nil, nil, fmt.Errorf("manifest has %d unmonitored instances (of %d sites), need %d",
+			len(openfeat), len(unmonitoredSites), *open)
+	}
+	return
+}
+
+// readWork reads the features of a work in dir, by the manifest if any.
+func readWork(dir, work string) (feat, openfeat [][]float64, files []string) {
+	if manifest == nil {
+		return readFeatures(dir)
+	}
+	feat, openfeat, files, err := readManifestFeatures(dir, work)
+	if err != nil {
+		log.Fatalf("failed to read work %s (%s)", work, err)
+	}
+	return
+}
+
+// siteOf is the site label of an instance file.
+func siteOf(file string) string {
+	if manifest != nil {
+		if e, exists := manifest.byPath[path.Clean(file)]; exists {
+			return e.Site
+		}
+	}
+	if index := strings.Index(file, "-"); index != -1 {
+		return file[:index]
+	}
+	return file
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+// Metric is a distance between the features of two instances, where a feature
+// with value -1 is missing.
+type Metric interface {
+	// Name is the short name of the metric, used in flags and attack names.
+	Name() string
+	// Dist calculates the distance from one instance to another, only
+	// considering the features present in from (presentFromFeat).
+	Dist(from, to, weight []float64, presentFromFeat []int) float64
+	// Weighted is true if feature weights are meaningful for the metric, i.e.,
+	// if it makes sense to learn weights with WLLCC.
+	Weighted() bool
+}
+
+// metricNames are all the supported metrics, in the order we list them.
+var metricNames = []string{"l1", "l2", "cosine", "jaccard"}
+
+func getMetric(name string) (Metric, error) {
+	switch name {
+	case "l1":
+		return weightedL1{}, nil
+	case "l2":
+		return weightedL2{}, nil
+	case "cosine":
+		return cosine{}, nil
+	case "jaccard":
+		return jaccard{}, nil
+	}
+	return nil, fmt.Errorf("unknown metric %q (supported: %s)",
+		name, strings.Join(metricNames, ", "))
+}
+
+// parseMetrics parses a comma-separated list of metric names.
+func parseMetrics(list string) (m []Metric, err error) {
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || seen[name] {
+			continue
+		}
+		metric, err := getMetric(name)
+		if err != nil {
+			return nil, err
+		}
+		m = append(m, metric)
+		seen[name] = true
+	}
+	if len(m) == 0 {
+		return nil, fmt.Errorf("no metric in %q", list)
+	}
+	return
+}
+
+// attackName is the name of the Wa-kNN attack with k neighbours using metric m.
+// The original weighted L1 metric is unnamed to keep results comparable.
+func attackName(k int, m Metric) string {
+	if _, ok := m.(weightedL1); ok {
+		return fmt.Sprintf("k%d-wf", k)
+	}
+	return fmt.Sprintf("k%d-wf-%s", k, m.Name())
+}
+
+// anyWeighted is true if weights are learned for any of the metrics.
+func anyWeighted(metrics []Metric) bool {
+	for _, m := range metrics {
+		if m.Weighted() {
+			return true
+		}
+	}
+	return false
+}
+
+// unitWeights are the weights used for metrics without weight learning.
+func unitWeights() (weight []float64) {
+	weight = make([]float64, FeatNum)
+	for i := 0; i < FeatNum; i++ {
+		weight[i] = 1
+	}
+	return
+}
+
+// weightedL1 is the weighted L1 (Manhattan) distance of Wang et al.
+type weightedL1 struct{}
+
+func (weightedL1) Name() string   { return "l1" }
+func (weightedL1) Weighted() bool { return true }
+
+func (weightedL1) Dist(from, to, weight []float64, presentFromFeat []int) (d float64) {
+	for _, i := range presentFromFeat {
+		if to[i] != -1 { // also present to?
+			d += weight[i] * math.Abs(from[i]-to[i])
+		}
+	}
+	return
+}
+
+// weightedL2 is the weighted L2 (Euclidean) distance.
+type weightedL2 struct{}
+
+func (weightedL2) Name() string   { return "l2" }
+func (weightedL2) Weighted() bool { return true }
+
+func (weightedL2) Dist(from, to, weight []float64, presentFromFeat []int) float64 {
+	var d float64
+	for _, i := range presentFromFeat {
+		if to[i] != -1 {
+			d += weight[i] * (from[i] - to[i]) * (from[i] - to[i])
+		}
+	}
+	return math.Sqrt(d)
+}
+
+// cosine is the cosine distance (1 - cosine similarity) over the features
+// present in both instances.
+type cosine struct{}
+
+func (cosine) Name() string   { return "cosine" }
+func (cosine) Weighted() bool { return false }
+
+func (cosine) Dist(from, to, weight []float64, presentFromFeat []int) float64 {
+	var dot, nfrom, nto float64
+	for _, i := range presentFromFeat {
+		if to[i] != -1 {
+			dot += weight[i] * from[i] * to[i]
+			nfrom += weight[i] * from[i] * from[i]
+			nto += weight[i] * to[i] * to[i]
+		}
+	}
+	if nfrom == 0 && nto == 0 {
+		return 0
+	}
+	if nfrom == 0 || nto == 0 {
+		return 1
+	}
+	return 1 - dot/math.Sqrt(nfrom*nto)
+}
+
+// jaccard is a set distance, 1 - |A∩B|/|A∪B|, where the set of an instance
+// are its present non-zero features. This is in the spirit of the Jaccard
+// attack by Liberatore and Levine on sets of packet lengths.
+type jaccard struct{}
+
+func (jaccard) Name() string   { return "jaccard" }
+func (jaccard) Weighted() bool { return false }
+
+func (jaccard) Dist(from, to, weight []float64, presentFromFeat []int) float64 {
+	var intersection, union float64
+	for i := 0; i < len(from) && i < len(to); i++ {
+		inFrom := from[i] != -1 && from[i] != 0
+		inTo := to[i] != -1 && to[i] != 0
+		if inFrom && inTo {
+			intersection += weight[i]
+		}
+		if inFrom || inTo {
+			union += weight[i]
+		}
+	}
+	if union == 0 {
+		return 0
+	}
+	return 1 - intersection/union
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+const (
+	// ModelVersion is the version of the model file format.
+	ModelVersion int = 1
+	// FeatureSet identifies the extracted features go-knn works on.
+	FeatureSet = "fixed"
+	// VotingUnanimous is the Wa-kNN voting rule: the k closest neighbours
+	// have to agree on a monitored site, otherwise the guess is unmonitored.
+	VotingUnanimous = "unanimous"
+)
+
+// modelFile is a learned Wa-kNN model for all work and folds of a run, from
+// which the learning can be skipped when re-evaluating or classifying.
+type modelFile struct {
+	Version    int         `json:"version"`
+	FeatureSet string      `json:"featureSet"`
+	FeatNum    int         `json:"featNum"`
+	Created    time.Time   `json:"created"`
+	Sites      int         `json:"sites"`
+	Instances  int         `json:"instances"`
+	Open       int         `json:"open"`
+	ROffset    int         `json:"roffset"`
+	Folds      int         `json:"folds"`
+	KMin       int         `json:"kMin"`
+	KMax       int         `json:"kMax"`
+	KStep      int         `json:"kStep"`
+	Voting     string      `json:"voting"`
+	Works      []workModel `json:"works"`
+}
+
+// workModel is the model for one work (sub-folder of the data dir).
+type workModel struct {
+	Name string `json:"name"`
+	Dir  string `json:"dir"`
+	// Instances are all instances of the work, monitored first.
+	Instances []instanceRef `json:"instances"`
+	// Labels are the manifest labels of the monitored sites by class, nil
+	// for sites numbered by file name.
+	Labels []string    `json:"labels,omitempty"`
+	Folds  []foldModel `json:"folds"`
+}
+
+// instanceRef refers to the features of an instance, relative to the work
+// dir, optionally with the (unnormalized) features embedded.
+type instanceRef struct {
+	File     string    `json:"file"`
+	Class    int       `json:"class"`
+	Features []float64 `json:"features,omitempty"`
+}
+
+// foldModel is what was learned in one fold.
+type foldModel struct {
+	Fold int `json:"fold"`
+	// Norm is the normalization fitted on the fold, nil for none.
+	Norm *scaler `json:"norm,omitempty"`
+	// Training are the indices of the instances of the training fold.
+	Training []int `json:"training"`
+	// Ignored are the instances neither trained nor tested on (time splits).
+	Ignored []int         `json:"ignored,omitempty"`
+	Metrics []metricModel `json:"metrics"`
+}
+
+// metricModel are the weights for a metric, with the WLLCC hyperparameters
+// used to learn them for weighted metrics.
+type metricModel struct {
+	Metric  string    `json:"metric"`
+	Rate    float64   `json:"rate,omitempty"`
+	Reco    int       `json:"reco,omitempty"`
+	InitMin float64   `json:"initMin,omitempty"`
+	InitMax float64   `json:"initMax,omitempty"`
+	Weights []float64 `json:"weights"`
+}
+
+func newModelFile(folds int) *modelFile {
+	return &modelFile{
+		Version:    ModelVersion,
+		FeatureSet: FeatureSet,
+		FeatNum:    FeatNum,
+		Created:    time.Now(),
+		Sites:      *sites,
+		Instances:  *instances,
+		Open:       *open,
+		ROffset:    *roffset,
+		Folds:      folds,
+		KMin:       *wKmin,
+		KMax:       *wKmax,
+		KStep:      *wKstep,
+		Voting:     VotingUnanimous,
+	}
+}
+
+// newWorkModel creates the model for a work with all its instances,
+// embedding their features if embed is set.
+func newWorkModel(name, dir string, feat, openfeat [][]float64, files []string,
+	embed bool) (w workModel) {
+	w.Name, w.Dir = name, dir
+	w.Instances = make([]instanceRef, len(files))
+	for i := 0; i < len(files); i++ {
+		w.Instances[i].File = files[i]
+		w.Instances[i].Class = classOf(i)
+		if embed && i < len(feat) {
+			w.Instances[i].Features = feat[i]
+		} else if embed {
+			w.Instances[i].Features = openfeat[i-len(feat)]
+		}
+	}
+	if manifest != nil {
+		for site := 0; site < len(feat) / *instances; site++ {
+			w.Labels = append(w.Labels, siteOf(files[site**instances]))
+		}
+	}
+	return
+}
+
+// addFold adds what was learned in a fold to the model of a work.
+func (w *workModel) addFold(fold int, s *scaler, weights [][]float64,
+	params []wllccParams) {
+	w.Folds = append(w.Folds, newFoldModel(fold, len(w.Instances), s, weights, params))
+}
+
+// newFoldModel is what was learned in a fold of a work with n instances.
+func newFoldModel(fold, n int, s *scaler, weights [][]float64,
+	params []wllccParams) (f foldModel) {
+	f.Fold = fold
+	if s != nil && s.Method != "none" {
+		f.Norm = s
+	}
+	for i := 0; i < n; i++ {
+		if instanceForTraining(i, fold) {
+			f.Training = append(f.Training, i)
+		} else if !instanceForTesting(i, fold) {
+			f.Ignored = append(f.Ignored, i)
+		}
+	}
+	for m := 0; m < len(distMetrics); m++ {
+		mm := metricModel{
+			Metric:  distMetrics[m].Name(),
+			Weights: weights[m],
+		}
+		if distMetrics[m].Weighted() {
+			mm.Rate, mm.Reco = params[m].rate, params[m].reco
+			mm.InitMin, mm.InitMax = params[m].initMin, params[m].initMax
+		}
+		f.Metrics = append(f.Metrics, mm)
+	}
+	return
+}
+
+func (mf *modelFile) save(name string) error {
+	data, err := json.Marshal(mf)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(name, data, 0666)
+}
+
+func loadModel(name string) (*modelFile, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	mf := new(modelFile)
+	if err = json.Unmarshal(data, mf); err != nil {
+		return nil, fmt.Errorf("failed to parse model %s (%s)", name, err)
+	}
+	if mf.Version != ModelVersion {
+		return nil, fmt.Errorf("unsupported model version %d (expected %d)",
+			mf.Version, ModelVersion)
+	}
+	if mf.FeatureSet != FeatureSet || mf.FeatNum != FeatNum {
+		return nil, fmt.Errorf("model is for feature set %q with %d features, expected %q with %d",
+			mf.FeatureSet, mf.FeatNum, FeatureSet, FeatNum)
+	}
+	return mf, nil
+}
+
+// work finds the model for a work by name, or the only work in the model.
+func (mf *modelFile) work(name string) (*workModel, error) {
+	for i := 0; i < len(mf.Works); i++ {
+		if mf.Works[i].Name == name {
+			return &mf.Works[i], nil
+		}
+	}
+	if len(mf.Works) == 1 {
+		return &mf.Works[0], nil
+	}
+	return nil, fmt.Errorf("no work %q in model", name)
+}
+
+// fold finds the model for a fold.
+func (w *workModel) fold(fold int) (*foldModel, error) {
+	for i := 0; i < len(w.Folds); i++ {
+		if w.Folds[i].Fold == fold {
+			return &w.Folds[i], nil
+		}
+	}
+	return nil, fmt.Errorf("no fold %d in model for work %q", fold, w.Name)
+}
+
+// weights finds the weights for a metric.
+func (f *foldModel) weights(metric string) ([]float64, error) {
+	for _, m := range f.Metrics {
+		if m.Metric == metric {
+			if len(m.Weights) != FeatNum {
+				return nil, fmt.Errorf("expected %d weights for metric %s, got %d",
+					FeatNum, metric, len(m.Weights))
+			}
+			return m.Weights, nil
+		}
+	}
+	return nil, fmt.Errorf("no weights for metric %s in fold %d", metric, f.Fold)
+}
+
+// params returns the WLLCC hyperparameters used for a metric.
+func (f *foldModel) params(metric string) (p wllccParams) {
+	for _, m := range f.Metrics {
+		if m.Metric == metric {
+			p = wllccParams{rate: m.Rate, reco: m.Reco, initMin: m.InitMin, initMax: m.InitMax}
+		}
+	}
+	return
+}
+
+// scaler returns the normalization of the fold, the identity if none.
+func (f *foldModel) scaler() *scaler {
+	if f.Norm != nil {
+		return f.Norm
+	}
+	s, _ := fitScaler("none", nil, nil, f.Fold)
+	return s
+}
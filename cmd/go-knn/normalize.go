@@ -0,0 +1,140 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// normNames are the supported feature normalizations.
+var normNames = []string{"none", "minmax", "zscore", "robust", "log"}
+
+func isNorm(method string) bool {
+	for _, n := range normNames {
+		if n == method {
+			return true
+		}
+	}
+	return false
+}
+
+// scaler normalizes each feature as (f(x) - shift) * scale, where f is the
+// identity or a log transform. Missing features (-1) are left as-is.
+type scaler struct {
+	Method string    `json:"method"`
+	Shift  []float64 `json:"shift"`
+	Scale  []float64 `json:"scale"`
+}
+
+// fitScaler fits a scaler with the given method on the training instances of
+// a fold, so that no information from testing instances leaks into it.
+func fitScaler(method string, feat, openfeat [][]float64, fold int) (*scaler, error) {
+	s := &scaler{
+		Method: method,
+		Shift:  make([]float64, FeatNum),
+		Scale:  make([]float64, FeatNum),
+	}
+	for i := 0; i < FeatNum; i++ {
+		s.Scale[i] = 1
+	}
+
+	if !isNorm(method) {
+		return nil, fmt.Errorf("unknown normalization %q (supported: %s)",
+			method, strings.Join(normNames, ", "))
+	}
+	if method == "none" || method == "log" {
+		return s, nil
+	}
+
+	values := make([]float64, 0, len(feat)+len(openfeat))
+	for j := 0; j < FeatNum; j++ {
+		// collect all present values of the feature in the training fold
+		values = values[:0]
+		for i := 0; i < len(feat); i++ {
+			if instanceForTraining(i, fold) && feat[i][j] != -1 {
+				values = append(values, feat[i][j])
+			}
+		}
+		for i := 0; i < len(openfeat); i++ {
+			if instanceForTraining(len(feat)+i, fold) && openfeat[i][j] != -1 {
+				values = append(values, openfeat[i][j])
+			}
+		}
+		if len(values) == 0 {
+			continue
+		}
+
+		var spread float64
+		switch method {
+		case "minmax":
+			min, max := values[0], values[0]
+			for _, v := range values {
+				min = math.Min(min, v)
+				max = math.Max(max, v)
+			}
+			s.Shift[j] = min
+			spread = max - min
+		case "zscore":
+			var sum, variance float64
+			for _, v := range values {
+				sum += v
+			}
+			mean := sum / float64(len(values))
+			for _, v := range values {
+				variance += (v - mean) * (v - mean) / float64(len(values))
+			}
+			s.Shift[j] = mean
+			spread = math.Sqrt(variance)
+		case "robust":
+			sort.Float64s(values)
+			s.Shift[j] = quantile(values, 0.5)
+			spread = quantile(values, 0.75) - quantile(values, 0.25)
+		}
+		// constant features are only shifted
+		if spread > 0 {
+			s.Scale[j] = 1 / spread
+		}
+	}
+
+	return s, nil
+}
+
+// transform returns a normalized copy of the features of an instance.
+func (s *scaler) transform(f []float64) (out []float64) {
+	out = make([]float64, len(f))
+	for i := 0; i < len(f); i++ {
+		if f[i] == -1 {
+			out[i] = -1
+			continue
+		}
+		v := f[i]
+		if s.Method == "log" {
+			// sign-preserving log transform, mainly for counts
+			v = math.Copysign(math.Log1p(math.Abs(v)), v)
+		}
+		out[i] = (v - s.Shift[i]) * s.Scale[i]
+		if out[i] == -1 {
+			// -1 marks missing features, stay (just) clear of it
+			out[i] = math.Nextafter(-1, 0)
+		}
+	}
+	return
+}
+
+// transformAll returns normalized copies of the features of all instances.
+func (s *scaler) transformAll(feat [][]float64) (out [][]float64) {
+	out = make([][]float64, len(feat))
+	for i := 0; i < len(feat); i++ {
+		out[i] = s.transform(feat[i])
+	}
+	return
+}
+
+// quantile returns the q-quantile of sorted values, linearly interpolated.
+func quantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	upper := int(math.Ceil(pos))
+	return sorted[lower] + (pos-float64(lower))*(sorted[upper]-sorted[lower])
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// MinChunk is the smallest number of distances computed by one goroutine
+// within a WLLCC round.
+const MinChunk int = 64
+
+// threads holds a token for each goroutine allowed to compute, bounding the
+// total concurrency of fold-level and round-level parallelism.
+var threads chan struct{}
+
+// initThreads allows n goroutines to compute at once, by default
+// NumCPU*workerFactor.
+func initThreads(n int) {
+	if n <= 0 {
+		n = runtime.NumCPU() * *workerFactor
+	}
+	threads = make(chan struct{}, n)
+}
+
+// acquire blocks until the goroutine may compute.
+func acquire() {
+	threads <- struct{}{}
+}
+
+func release() {
+	<-threads
+}
+
+// parallel calls fn on chunks of [0, n), spreading the chunks over as many
+// goroutines as there are free threads and computing the rest itself. The
+// caller should hold a thread.
+func parallel(n int, fn func(from, to int)) {
+	chunks := n / MinChunk
+	if chunks > cap(threads) {
+		chunks = cap(threads)
+	}
+	if chunks <= 1 {
+		fn(0, n)
+		return
+	}
+
+	wg := new(sync.WaitGroup)
+	size := (n + chunks - 1) / chunks
+	for from := size; from < n; from += size {
+		to := from + size
+		if to > n {
+			to = n
+		}
+		select {
+		case threads <- struct{}{}:
+			wg.Add(1)
+			go func(from, to int) {
+				defer wg.Done()
+				defer release()
+				fn(from, to)
+			}(from, to)
+		default:
+			fn(from, to)
+		}
+	}
+	fn(0, size)
+	wg.Wait()
+}
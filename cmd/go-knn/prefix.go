@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// prefixSpec is a truncation of a trace: a percentage of its cells, its first
+// cells, or its first seconds.
+type prefixSpec struct {
+	value float64
+	unit  string // "%", "c", or "s"
+}
+
+// parsePrefixSpecs parses a comma-separated list of prefixes, such as
+// "10%,25%,100c,2.5s".
+func parsePrefixSpecs(list string) (specs []prefixSpec, err error) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		unit := s[len(s)-1:]
+		if unit != "%" && unit != "c" && unit != "s" {
+			return nil, fmt.Errorf("prefix %q needs a unit (%%, c, or s)", s)
+		}
+		value, err := strconv.ParseFloat(s[:len(s)-1], 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad prefix %q (%s)", s, err)
+		}
+		if value <= 0 || (unit == "%" && value > 100) ||
+			(unit == "c" && value != math.Trunc(value)) {
+			return nil, fmt.Errorf("bad prefix %q", s)
+		}
+		specs = append(specs, prefixSpec{value: value, unit: unit})
+	}
+	return
+}
+
+// label names the prefix in attack names, distinct from streaming labels.
+func (p prefixSpec) label() string {
+	return "first" + strconv.FormatFloat(p.value, 'f', -1, 64) + p.unit
+}
+
+// cells returns how many cells of a trace are in the prefix, at least one
+// for a non-empty trace.
+func (p prefixSpec) cells(times []float64) (n int) {
+	switch p.unit {
+	case "%":
+		n = int(math.Ceil(p.value / 100 * float64(len(times))))
+	case "c":
+		n = int(p.value)
+	case "s":
+		for n < len(times) && times[n]-times[0] <= p.value {
+			n++
+		}
+	}
+	if n < 1 {
+		n = 1
+	}
+	if n > len(times) {
+		n = len(times)
+	}
+	return
+}
+
+// truncatedPrefixes extracts the features of each prefix of a trace by
+// re-extracting them from the truncated trace.
+func truncatedPrefixes(times []float64, sizes []int,
+	specs []prefixSpec) (prefixes []prefix, err error) {
+	for _, spec := range specs {
+		n := spec.cells(times)
+		feat, err := extractFeatures(times[:n], sizes[:n])
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix{label: spec.label(), feat: feat})
+	}
+	return
+}
+
+// prefixLess orders prefix labels: streaming cells, streaming seconds, then
+// the -prefixes in the same order, each by length.
+func prefixLess(a, b string) bool {
+	rank := func(label string) (int, float64) {
+		kind := 0
+		if strings.HasPrefix(label, "first") {
+			kind, label = 3, strings.TrimPrefix(label, "first")
+		}
+		switch label[len(label)-1:] {
+		case "s":
+			kind++
+		case "%":
+			kind += 2
+		}
+		value, _ := strconv.ParseFloat(label[:len(label)-1], 64)
+		return kind, value
+	}
+	kindA, valueA := rank(a)
+	kindB, valueB := rank(b)
+	if kindA != kindB {
+		return kindA < kindB
+	}
+	return valueA < valueB
+}
+
+// writePrefixes writes the metrics of each attack by prefix, taken from the
+// attack columns named attack@prefix, with the whole trace last.
+func writePrefixes(results []map[string][]metrics, // work -> map["attack"] -> [folds]metrics
+	subfold []string, name string) {
+	out := bytes.NewBufferString("work,attack,prefix,recall,precision,f1score,fpr,accuracy\n")
+	for sub := 0; sub < len(subfold); sub++ {
+		byAttack := make(map[string][]string)
+		for attack := range results[sub] {
+			if index := strings.Index(attack, "@"); index != -1 {
+				base := attack[:index]
+				byAttack[base] = append(byAttack[base], attack[index+1:])
+			}
+		}
+		var attacks []string
+		for attack := range byAttack {
+			attacks = append(attacks, attack)
+		}
+		sort.Strings(attacks)
+		for _, attack := range attacks {
+			labels := byAttack[attack]
+			sort.Slice(labels, func(i, j int) bool { return prefixLess(labels[i], labels[j]) })
+			row := func(label string, m []metrics) {
+				str2buf(fmt.Sprintf("%s,%s,%s,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+					csvField(subfold[sub]), attack, label,
+					recall(m), precision(m), f1score(m), fpr(m), accuracy(m)), out)
+			}
+			for _, label := range labels {
+				row(label, results[sub][attack+"@"+label])
+			}
+			if m, exists := results[sub][attack]; exists {
+				row("all", m)
+			}
+		}
+	}
+	writeFile(out.String(), name)
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// server is an HTTP/JSON classification service around a model, where the
+// model can be reloaded without a restart.
+type server struct {
+	flags classifierFlags
+
+	mu        sync.RWMutex
+	c         *classifier
+	modelName string
+	loaded    time.Time
+}
+
+// classifyRequest is an instance to classify: either its cells as (time,
+// size) pairs or its already extracted features.
+type classifyRequest struct {
+	Cells      [][2]float64 `json:"cells,omitempty"`
+	Features   []float64    `json:"features,omitempty"`
+	Candidates int          `json:"candidates,omitempty"`
+}
+
+// reloadRequest names the model file to reload, relative to the folder of
+// -model, by default the served model.
+type reloadRequest struct {
+	Model string `json:"model,omitempty"`
+}
+
+// modelInfo is the metadata of the served model.
+type modelInfo struct {
+	File       string    `json:"file"`
+	Loaded     time.Time `json:"loaded"`
+	Version    int       `json:"version"`
+	FeatureSet string    `json:"featureSet"`
+	FeatNum    int       `json:"featNum"`
+	Created    time.Time `json:"created"`
+	Sites      int       `json:"sites"`
+	Instances  int       `json:"instances"`
+	Open       int       `json:"open"`
+	Work       string    `json:"work"`
+	Fold       int       `json:"fold"`
+	Metric     string    `json:"metric"`
+	Norm       string    `json:"norm"`
+	K          int       `json:"k"`
+	Voting     string    `json:"voting"`
+	References int       `json:"references"`
+}
+
+// reload sets up a classifier with a model file and swaps it in.
+func (s *server) reload(modelName string) error {
+	c, err := s.flags.load(modelName)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.c, s.modelName, s.loaded = c, modelName, time.Now()
+	log.Printf("serving model %s (work %s, fold %d, metric %s)",
+		modelName, c.work.Name, c.fold.Fold, c.metric.Name())
+	return nil
+}
+
+func (s *server) info() modelInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return modelInfo{
+		File:       s.modelName,
+		Loaded:     s.loaded,
+		Version:    s.c.model.Version,
+		FeatureSet: s.c.model.FeatureSet,
+		FeatNum:    s.c.model.FeatNum,
+		Created:    s.c.model.Created,
+		Sites:      s.c.model.Sites,
+		Instances:  s.c.model.Instances,
+		Open:       s.c.model.Open,
+		Work:       s.c.work.Name,
+		Fold:       s.c.fold.Fold,
+		Metric:     s.c.metric.Name(),
+		Norm:       s.c.scaler.Method,
+		K:          s.c.k,
+		Voting:     s.c.model.Voting,
+		References: len(s.c.fold.Training),
+	}
+}
+
+func (s *server) handleModel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeError(w, http.StatusMethodNotAllowed, "use GET")
+		return
+	}
+	writeJSON(w, http.StatusOK, s.info())
+}
+
+func (s *server) handleClassify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var req classifyRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("bad request (%s)", err))
+		return
+	}
+
+	feat := req.Features
+	if req.Cells != nil {
+		times := make([]float64, len(req.Cells))
+		sizes := make([]int, len(req.Cells))
+		for i, cell := range req.Cells {
+			times[i], sizes[i] = cell[0], int(cell[1])
+		}
+		var err error
+		if feat, err = extractFeatures(times, sizes); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("failed to extract features (%s)", err))
+			return
+		}
+	}
+	if len(feat) != FeatNum {
+		writeError(w, http.StatusBadRequest,
+			fmt.Sprintf("need cells or %d features, got %d features", FeatNum, len(feat)))
+		return
+	}
+	n := req.Candidates
+	if n <= 0 {
+		n = *s.flags.n
+	}
+
+	s.mu.RLock()
+	p := s.c.classify(feat, n)
+	s.mu.RUnlock()
+	writeJSON(w, http.StatusOK, p)
+}
+
+func (s *server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	var req reloadRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("bad request (%s)", err))
+			return
+		}
+	}
+	name, err := s.modelPath(req.Model)
+	if err != nil {
+		writeError(w, http.StatusForbidden, err.Error())
+		return
+	}
+	if err := s.reload(name); err != nil {
+		writeError(w, http.StatusUnprocessableEntity, fmt.Sprintf("failed to reload (%s)", err))
+		return
+	}
+	writeJSON(w, http.StatusOK, s.info())
+}
+
+// modelPath is the file of a model to reload: the served model if name is
+// empty, otherwise name in the folder of -model, which it cannot leave.
+func (s *server) modelPath(name string) (string, error) {
+	if name == "" {
+		s.mu.RLock()
+		defer s.mu.RUnlock()
+		return s.modelName, nil
+	}
+	clean := path.Clean(name)
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("model %s is not in the folder of -model", name)
+	}
+	return path.Join(path.Dir(*s.flags.model), clean), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("failed to write response (%s)", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
+
+// serveMain is the serve subcommand: a long-lived classification service.
+// The model is reloaded on SIGHUP or POST /reload.
+func serveMain(args []string) {
+	fs := newFlagSet("serve")
+	s := &server{flags: addClassifierFlags(fs)}
+	addr := fs.String("addr", "127.0.0.1:8080", "the address to listen on")
+	usage := fs.Usage
+	fs.Usage = func() {
+		usage()
+		fmt.Fprintf(os.Stderr, "\nendpoints: POST /classify, GET /model, POST /reload\n")
+	}
+	fs.Parse(args)
+	if *s.flags.model == "" {
+		usageError(fs, "need to specify -model")
+	}
+	if err := s.reload(*s.flags.model); err != nil {
+		log.Fatalf("failed to set up classifier (%s)", err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			s.mu.RLock()
+			name := s.modelName
+			s.mu.RUnlock()
+			if err := s.reload(name); err != nil {
+				log.Printf("failed to reload model (%s)", err)
+			}
+		}
+	}()
+
+	http.HandleFunc("/classify", s.handleClassify)
+	http.HandleFunc("/model", s.handleModel)
+	http.HandleFunc("/reload", s.handleReload)
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, nil))
+}
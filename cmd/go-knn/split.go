@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// splitNames are the supported cross-validation splits.
+var splitNames = []string{"contiguous", "stratified", "repeated", "holdout", "time"}
+
+// Splitter assigns instances (indexed monitored first, then open world) to
+// the testing fold of each split of a cross-validation, and to its training
+// fold (usually all other instances).
+type Splitter interface {
+	Name() string
+	// Folds is the number of splits, each with its own testing fold.
+	Folds() int
+	Testing(i, fold int) bool
+	Training(i, fold int) bool
+}
+
+// split is the splitter of the current work, nil for the contiguous split
+// of -folds by instance number.
+var split Splitter
+
+// contiguousSplit tests the same contiguous range of instance numbers of
+// every monitored site in a fold, and a contiguous range of the unmonitored
+// sites or, with -open-by-number, the open-world instances with those numbers.
+type contiguousSplit struct {
+	k int
+	// openFold is the fold of each open-world instance, nil to split them by
+	// instance number like the monitored instances
+	openFold []int
+}
+
+func (s contiguousSplit) Name() string { return "contiguous" }
+func (s contiguousSplit) Folds() int   { return s.k }
+
+func (s contiguousSplit) Testing(i, fold int) bool {
+	if i >= *sites**instances && s.openFold != nil {
+		// the open world is split on its own, independent of instances
+		return s.openFold[i-*sites**instances] == fold
+	}
+	foldSize := *instances / s.k
+	// the instances at [fold*foldSize,(fold+1)*foldSize) are for testing
+	return i%*instances >= fold*foldSize && i%*instances < (fold+1)*foldSize
+}
+
+func (s contiguousSplit) Training(i, fold int) bool {
+	return !s.Testing(i, fold)
+}
+
+// tableSplit is a split with an explicit assignment.
+type tableSplit struct {
+	name    string
+	testing [][]bool // fold -> instance -> testing
+	// training is fold -> instance -> training, nil for all not testing
+	training [][]bool
+}
+
+func (s *tableSplit) Name() string { return s.name }
+func (s *tableSplit) Folds() int   { return len(s.testing) }
+
+func (s *tableSplit) Testing(i, fold int) bool {
+	return s.testing[fold][i]
+}
+
+func (s *tableSplit) Training(i, fold int) bool {
+	if s.training == nil {
+		return !s.testing[fold][i]
+	}
+	return s.training[fold][i]
+}
+
+// trainOnly makes the training folds explicit, initially empty.
+func (s *tableSplit) trainOnly() {
+	s.training = make([][]bool, len(s.testing))
+	for f := range s.training {
+		s.training[f] = make([]bool, len(s.testing[f]))
+	}
+}
+
+func newTableSplit(name string, folds, n int) *tableSplit {
+	s := &tableSplit{name: name, testing: make([][]bool, folds)}
+	for f := 0; f < folds; f++ {
+		s.testing[f] = make([]bool, n)
+	}
+	return s
+}
+
+// openGroups groups the open-world instances (by combined index) that have
+// to be in the same fold: all instances of an unmonitored site if unseen is
+// set, such that sites seen in training are never tested, otherwise each
+// instance on its own.
+func openGroups(files []string, unseen bool) (groups [][]int) {
+	group := make(map[string]int)
+	for i := *sites * *instances; i < len(files); i++ {
+		site := siteOf(files[i])
+		if g, exists := group[site]; exists && unseen {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		group[site] = len(groups)
+		groups = append(groups, []int{i})
+	}
+	return
+}
+
+// strata are the instances of each monitored site, which are split alike.
+func strata() (monitored [][]int) {
+	for site := 0; site < *sites; site++ {
+		var group []int
+		for j := site * *instances; j < (site+1)**instances; j++ {
+			group = append(group, j)
+		}
+		monitored = append(monitored, group)
+	}
+	return
+}
+
+// stratifiedSplit shuffles the instances of each monitored site into k
+// folds, and the open-world groups as a whole, repeated with new shuffles.
+// Leftovers of strata that do not split evenly are spread over the folds.
+func stratifiedSplit(k, repeats int, openGroups [][]int, n int, rng *rand.Rand) *tableSplit {
+	name := "stratified"
+	if repeats > 1 {
+		name = "repeated"
+	}
+	s := newTableSplit(name, k*repeats, n)
+	for r := 0; r < repeats; r++ {
+		next := 0
+		for _, group := range strata() {
+			for c, p := range rng.Perm(len(group)) {
+				s.testing[r*k+(next+c)%k][group[p]] = true
+			}
+			next += len(group)
+		}
+		for c, p := range rng.Perm(len(openGroups)) {
+			for _, i := range openGroups[p] {
+				s.testing[r*k+(next+c)%k][i] = true
+			}
+		}
+	}
+	return s
+}
+
+// holdoutSplit tests a random fraction of each monitored site and of the
+// open-world groups, in a single fold.
+func holdoutSplit(fraction float64, openGroups [][]int, n int, rng *rand.Rand) *tableSplit {
+	s := newTableSplit("holdout", 1, n)
+	count := func(n int) int {
+		if n == 0 {
+			return 0
+		}
+		c := int(math.Round(fraction * float64(n)))
+		if c >= n {
+			c = n - 1 // keep something to train on
+		}
+		return c
+	}
+	for _, group := range strata() {
+		for _, p := range rng.Perm(len(group))[:count(len(group))] {
+			s.testing[0][group[p]] = true
+		}
+	}
+	for _, p := range rng.Perm(len(openGroups))[:count(len(openGroups))] {
+		for _, i := range openGroups[p] {
+			s.testing[0][i] = true
+		}
+	}
+	return s
+}
+
+// splitFolds checks the split flags and returns the number of folds of the
+// split.
+func splitFolds() (int, error) {
+	if *testData != "" {
+		return 1, nil
+	}
+	if *splitFile != "" {
+		splits, err := readSplits(*splitFile)
+		if err != nil {
+			return 0, err
+		}
+		folds := -1
+		for work, s := range splits {
+			if folds != -1 && s.Folds() != folds {
+				return 0, fmt.Errorf("work %s has %d folds, others %d", work, s.Folds(), folds)
+			}
+			folds = s.Folds()
+		}
+		return folds, nil
+	}
+	if *folds < 1 {
+		return 0, fmt.Errorf("need at least one fold")
+	}
+	if *openByNumber && (*splitName != "contiguous" || *unseenOpen || *openInstances > 1) {
+		return 0, fmt.Errorf("-open-by-number is only for the contiguous split without -unseen-open or -open-instances")
+	}
+	switch *splitName {
+	case "contiguous":
+		if *instances%*folds != 0 {
+			return 0, fmt.Errorf("k (%d) has to fold instances (%d) evenly", *folds, *instances)
+		}
+		return *folds, nil
+	case "stratified":
+		return *folds, nil
+	case "repeated":
+		if *repeats < 1 {
+			return 0, fmt.Errorf("need at least one repeat")
+		}
+		return *folds * *repeats, nil
+	case "holdout":
+		if *holdout <= 0 || *holdout >= 1 {
+			return 0, fmt.Errorf("need 0 < holdout < 1")
+		}
+		return 1, nil
+	case "time":
+		_, test, err := timePeriods()
+		return len(test), err
+	}
+	return 0, fmt.Errorf("unknown split %q (supported: %s)", *splitName,
+		strings.Join(splitNames, ", "))
+}
+
+// workSplit creates the split of a work with the instances in files (in dir):
+// the split of the work in the loaded model (if any and of the same
+// dataset), of the split file, or by the split flags.
+func workSplit(work, dir string, files []string, loaded *workModel) (Splitter, error) {
+	if *testData != "" {
+		return crossSplit(len(files)), nil
+	}
+	if loaded != nil && len(loaded.Instances) == len(files) {
+		return modelSplit(loaded)
+	}
+	if *splitFile != "" {
+		splits, err := readSplits(*splitFile)
+		if err != nil {
+			return nil, err
+		}
+		s, exists := splits[work]
+		if !exists && len(splits) == 1 {
+			for _, s = range splits {
+			}
+		} else if !exists {
+			return nil, fmt.Errorf("no split for work %s in %s", work, *splitFile)
+		}
+		if s.Folds() > 0 && len(s.testing[0]) != len(files) {
+			return nil, fmt.Errorf("split of work %s has %d instances, work has %d",
+				work, len(s.testing[0]), len(files))
+		}
+		return s, nil
+	}
+
+	if *splitName == "time" {
+		times, err := instanceTimes(dir, files)
+		if err != nil {
+			return nil, err
+		}
+		return timeSplit(times)
+	}
+
+	if *splitName == "contiguous" && *openByNumber {
+		return contiguousSplit{k: *folds}, nil
+	}
+	// several instances of an unmonitored site are never split up
+	groups := openGroups(files, *unseenOpen || *openInstances > 1)
+	if len(groups) > 0 && len(groups) < *folds && *splitName != "holdout" {
+		return nil, fmt.Errorf("%d unmonitored sites cannot be split into %d folds",
+			len(groups), *folds)
+	}
+	rng := rand.New(rand.NewSource(*seed))
+	switch *splitName {
+	case "contiguous":
+		// consecutive unmonitored sites share a fold
+		s := contiguousSplit{k: *folds, openFold: make([]int, len(files)-*sites**instances)}
+		for g, group := range groups {
+			for _, i := range group {
+				s.openFold[i-*sites**instances] = g * *folds / len(groups)
+			}
+		}
+		return s, nil
+	case "stratified":
+		return stratifiedSplit(*folds, 1, groups, len(files), rng), nil
+	case "repeated":
+		return stratifiedSplit(*folds, *repeats, groups, len(files), rng), nil
+	}
+	return holdoutSplit(*holdout, groups, len(files), rng), nil
+}
+
+// crossSplit trains on all n instances of the data dir and tests all n
+// instances of the test data dir, in a single fold.
+func crossSplit(n int) Splitter {
+	s := newTableSplit("cross", 1, n)
+	s.trainOnly()
+	for i := 0; i < n; i++ {
+		s.testing[0][i], s.training[0][i] = true, true
+	}
+	return s
+}
+
+// modelSplit is the split a work model was learned with, testing all but
+// the training and ignored instances of each fold.
+func modelSplit(w *workModel) (Splitter, error) {
+	s := newTableSplit("model", len(w.Folds), len(w.Instances))
+	s.trainOnly()
+	for f := 0; f < len(w.Folds); f++ {
+		fm, err := w.fold(f)
+		if err != nil {
+			return nil, err
+		}
+		for i := range s.testing[f] {
+			s.testing[f][i] = true
+		}
+		for _, i := range append(fm.Training, fm.Ignored...) {
+			if i < 0 || i >= len(w.Instances) {
+				return nil, fmt.Errorf("instance %d out of range", i)
+			}
+			s.testing[f][i] = false
+		}
+		for _, i := range fm.Training {
+			s.training[f][i] = true
+		}
+	}
+	return s, nil
+}
+
+// SplitHeader is the header of split files.
+const SplitHeader = "work,instance,file,class,testing,training"
+
+// splitRows adds the folds each instance of a work is tested and trained in
+// to a split file, such that the split can be reproduced with -split-file.
+func splitRows(s Splitter, work string, files []string, out *bytes.Buffer) {
+	w := csv.NewWriter(out)
+	for i := 0; i < len(files); i++ {
+		var testing, training []string
+		for f := 0; f < s.Folds(); f++ {
+			if s.Testing(i, f) {
+				testing = append(testing, strconv.Itoa(f))
+			}
+			if s.Training(i, f) {
+				training = append(training, strconv.Itoa(f))
+			}
+		}
+		w.Write([]string{work, strconv.Itoa(i), files[i], strconv.Itoa(classOf(i)),
+			strings.Join(testing, " "), strings.Join(training, " ")})
+	}
+	w.Flush()
+}
+
+// readSplits reads the split of each work in a split file.
+func readSplits(name string) (map[string]*tableSplit, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	// work -> instance -> testing and training folds
+	testing := make(map[string][][]int)
+	training := make(map[string][][]int)
+	folds := 0
+	r := csv.NewReader(file)
+	r.FieldsPerRecord = -1
+	for line := 0; ; line++ {
+		items, err := r.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to parse %s (%s)", name, err)
+		}
+		if line == 0 {
+			if strings.Join(items, ",") != SplitHeader {
+				return nil, fmt.Errorf("%s is not a split file", name)
+			}
+			continue
+		}
+		if len(items) != 6 {
+			return nil, fmt.Errorf("expected 6 items in line %d of %s, got %d", line+1, name, len(items))
+		}
+		work := items[0]
+		i, err := strconv.Atoi(items[1])
+		if err != nil || i != len(testing[work]) {
+			return nil, fmt.Errorf("bad instance %q in line %d of %s", items[1], line+1, name)
+		}
+		var fs [2][]int
+		for c := 0; c < 2; c++ {
+			for _, f := range strings.Fields(items[4+c]) {
+				fold, err := strconv.Atoi(f)
+				if err != nil || fold < 0 {
+					return nil, fmt.Errorf("bad fold %q in line %d of %s", f, line+1, name)
+				}
+				fs[c] = append(fs[c], fold)
+				if fold >= folds {
+					folds = fold + 1
+				}
+			}
+		}
+		testing[work] = append(testing[work], fs[0])
+		training[work] = append(training[work], fs[1])
+	}
+	if folds == 0 {
+		return nil, fmt.Errorf("no folds in %s", name)
+	}
+
+	splits := make(map[string]*tableSplit)
+	for work, rows := range testing {
+		if len(rows) < *sites**instances {
+			return nil, fmt.Errorf("work %s has %d instances in %s, expected at least %d",
+				work, len(rows), name, *sites**instances)
+		}
+		s := newTableSplit("file", folds, len(rows))
+		s.trainOnly()
+		for i, fs := range rows {
+			for _, fold := range fs {
+				s.testing[fold][i] = true
+			}
+			for _, fold := range training[work][i] {
+				s.training[fold][i] = true
+			}
+		}
+		splits[work] = s
+	}
+	return splits, nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// setFlags sets flags for a test, restoring them when it ends.
+func setFlags(t *testing.T, values map[string]string) {
+	for name, value := range values {
+		old := flag.Lookup(name).Value.String()
+		if err := flag.Set(name, value); err != nil {
+			t.Fatalf("failed to set -%s (%s)", name, err)
+		}
+		t.Cleanup(func() { flag.Set(name, old) })
+	}
+}
+
+// testFiles are go-knn file names of the dataset of the flags, with
+// openInstances instances of each unmonitored site.
+func testFiles(openInstances int) (files []string) {
+	for site := 1; site <= *sites; site++ {
+		for i := 0; i < *instances; i++ {
+			files = append(files, strconv.Itoa(site)+"-"+strconv.Itoa(i)+FeatureSuffix)
+		}
+	}
+	for j := 0; j < *open; j++ {
+		site := *sites + 1 + j/openInstances
+		files = append(files, strconv.Itoa(site)+"-"+strconv.Itoa(j%openInstances)+FeatureSuffix)
+	}
+	return
+}
+
+func TestSplittersDisjoint(t *testing.T) {
+	setFlags(t, map[string]string{"sites": "4", "instances": "6", "folds": "3",
+		"repeats": "2", "holdout": "0.3", "period": "1h", "train-periods": "1-2",
+		"test-periods": "3", "wreco": "1"})
+	// with and without an open world
+	for _, openWorld := range []string{"12", "0"} {
+		setFlags(t, map[string]string{"open": openWorld})
+		files := testFiles(2)
+		rng := rand.New(rand.NewSource(1))
+		groups := openGroups(files, true)
+
+		// a time split with two instances of every site in each of three periods
+		start := time.Unix(0, 0)
+		times := make([]time.Time, len(files))
+		for i := range times {
+			times[i] = start.Add(time.Duration(i%3) * time.Hour)
+		}
+		timed, err := timeSplit(times)
+		if err != nil {
+			t.Fatalf("time split, open %s, failed (%s)", openWorld, err)
+		}
+		contiguous := contiguousSplit{k: *folds}
+		limited, err := limitTraining(contiguous, 2, len(files), 1)
+		if err != nil {
+			t.Fatalf("limiting training, open %s, failed (%s)", openWorld, err)
+		}
+		openFold := make([]int, *open)
+		for g, group := range groups {
+			for _, i := range group {
+				openFold[i-*sites**instances] = g * *folds / len(groups)
+			}
+		}
+
+		for _, s := range []Splitter{
+			contiguous,
+			contiguousSplit{k: *folds, openFold: openFold},
+			stratifiedSplit(*folds, 1, groups, len(files), rng),
+			stratifiedSplit(*folds, *repeats, openGroups(files, false), len(files), rng),
+			holdoutSplit(*holdout, groups, len(files), rng),
+			timed,
+			limited,
+		} {
+			for fold := 0; fold < s.Folds(); fold++ {
+				tested := 0
+				for i := range files {
+					if s.Testing(i, fold) && s.Training(i, fold) {
+						t.Errorf("%s split, open %s: instance %d is testing and training in fold %d",
+							s.Name(), openWorld, i, fold)
+					}
+					if s.Testing(i, fold) {
+						tested++
+					}
+				}
+				if tested == 0 {
+					t.Errorf("%s split, open %s: nothing to test in fold %d", s.Name(), openWorld, fold)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"math"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// streamExtractor incrementally extracts the same features as extract, as
+// the cells of a trace arrive.
+type streamExtractor struct {
+	n          int // cells so far
+	outgoing   int
+	start, end float64
+
+	// position of, and difference in position between, outgoing cells
+	positions, deltas []int
+	prevloc           int
+
+	// packet distribution over chunks of 30 cells
+	chunks     []int
+	chunkCount int
+
+	// bursts, as in extract the current burst is not counted until it ends
+	bursts     []int
+	burstOut   bool
+	burstCount int
+
+	firstSizes []int
+
+	// interpacket timing
+	prevTime, timeSum, timeSqSum float64
+}
+
+func newStreamExtractor() *streamExtractor {
+	return &streamExtractor{burstOut: true}
+}
+
+// add appends a cell to the trace.
+func (s *streamExtractor) add(time float64, size int) {
+	i := s.n
+	s.n++
+	if i == 0 {
+		s.start = time
+	} else {
+		d := time - s.prevTime
+		s.timeSum += d
+		s.timeSqSum += d * d
+	}
+	s.end, s.prevTime = time, time
+
+	if size > 0 {
+		s.outgoing++
+		if len(s.positions) < 500 {
+			s.positions = append(s.positions, i)
+			s.deltas = append(s.deltas, i-s.prevloc)
+			s.prevloc = i
+		}
+	}
+
+	if i < 3000 {
+		if i%30 != 29 {
+			if size > 0 {
+				s.chunkCount++
+			}
+		} else {
+			s.chunks = append(s.chunks, s.chunkCount)
+			s.chunkCount = 0
+		}
+	}
+
+	if size > 0 == s.burstOut {
+		s.burstCount++
+	} else {
+		if s.burstCount > 1 {
+			s.bursts = append(s.bursts, s.burstCount)
+		}
+		s.burstCount = 1
+		s.burstOut = size > 0
+	}
+
+	if len(s.firstSizes) < 10 {
+		s.firstSizes = append(s.firstSizes, size)
+	}
+}
+
+// features returns the features of the trace so far.
+func (s *streamExtractor) features() (feat []float64) {
+	feat = make([]float64, 0, FeatNum)
+	appendInts := func(values []int, offset, pad int) {
+		for _, v := range values {
+			feat = append(feat, float64(v+offset))
+		}
+		for i := len(values); i < pad; i++ {
+			feat = append(feat, -1)
+		}
+	}
+
+	feat = append(feat, float64(s.n), float64(s.outgoing), float64(s.n-s.outgoing),
+		s.end-s.start)
+	appendInts(s.positions, 0, 500)
+	appendInts(s.deltas, 0, 500)
+	appendInts(s.chunks, 0, 0)
+	for i := len(s.chunks); i < 100; i++ {
+		feat = append(feat, 0)
+	}
+
+	max, sum := -1, 0
+	counts := make([]int, 6)
+	for _, b := range s.bursts {
+		sum += b
+		if b > max {
+			max = b
+		}
+		for j, limit := range []int{2, 5, 10, 15, 20, 50} {
+			if b > limit {
+				counts[j]++
+			}
+		}
+	}
+	feat = append(feat, float64(max))
+	if len(s.bursts) > 0 {
+		feat = append(feat, float64(sum/len(s.bursts)))
+	} else {
+		feat = append(feat, 0)
+	}
+	feat = append(feat, float64(len(s.bursts)))
+	appendInts(counts, 0, 0)
+	if len(s.bursts) > 100 {
+		appendInts(s.bursts[:100], 0, 100)
+	} else {
+		appendInts(s.bursts, 0, 100)
+	}
+	appendInts(s.firstSizes, 1500, 10)
+
+	// the variance is summed before dividing, so it may differ from extract
+	// in the last bits
+	mean := s.timeSum / float64(s.n-1)
+	variance := s.timeSqSum / float64(s.n-2)
+	if s.n == 1 {
+		variance = 0
+	}
+	for _, v := range []float64{mean, math.Sqrt(variance)} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			// as parseFeatureString
+			v = -1
+		}
+		feat = append(feat, v)
+	}
+	return
+}
+
+// prefix is the features of a prefix of a trace, named by its length.
+type prefix struct {
+	label string
+	feat  []float64
+}
+
+// streamPrefixes streams a trace through the extractor, taking the features
+// after every everyCells cells or everyTime seconds (relative to the first
+// cell) for points checkpoints. Checkpoints beyond the end of the trace get
+// the features of the full trace.
+func streamPrefixes(times []float64, sizes []int, everyCells int, everyTime float64,
+	points int) (prefixes []prefix) {
+	s := newStreamExtractor()
+	for i := 0; i < len(times); i++ {
+		if everyTime > 0 {
+			// take all checkpoints passed before this cell
+			for len(prefixes) < points &&
+				times[i]-times[0] > float64(len(prefixes)+1)*everyTime && s.n > 0 {
+				prefixes = append(prefixes, prefix{
+					label: timeLabel(float64(len(prefixes)+1) * everyTime),
+					feat:  s.features()})
+			}
+		}
+		s.add(times[i], sizes[i])
+		if everyCells > 0 && s.n%everyCells == 0 && len(prefixes) < points {
+			prefixes = append(prefixes, prefix{
+				label: strconv.Itoa(s.n) + "c",
+				feat:  s.features()})
+		}
+		if len(prefixes) == points {
+			return
+		}
+	}
+
+	// the trace ended early: the rest of the checkpoints see everything
+	for len(prefixes) < points && s.n > 0 {
+		label := strconv.Itoa((len(prefixes)+1)*everyCells) + "c"
+		if everyTime > 0 {
+			label = timeLabel(float64(len(prefixes)+1) * everyTime)
+		}
+		prefixes = append(prefixes, prefix{label: label, feat: s.features()})
+	}
+	return
+}
+
+func timeLabel(t float64) string {
+	return strconv.FormatFloat(t, 'f', -1, 64) + "s"
+}
+
+// streaming is true if go-knn should evaluate streaming classification.
+func streaming() bool {
+	return *streamCells > 0 || *streamTime > 0
+}
+
+// traceFile is the name of the cell trace of a feature file in tracedir.
+func traceFile(tracedir, featureFile string) string {
+	return path.Join(tracedir, strings.TrimSuffix(featureFile, FeatureSuffix))
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// testTrace is a synthetic cell trace of n cells, with bursts of up to
+// maxBurst cells in a direction and cells every up to gap seconds.
+func testTrace(n, maxBurst int, gap float64, seed int64) (times []float64, sizes []int) {
+	rng := rand.New(rand.NewSource(seed))
+	t, dir := 0.0, 1
+	for len(times) < n {
+		for b := rng.Intn(maxBurst) + 1; b > 0 && len(times) < n; b-- {
+			times = append(times, t)
+			sizes = append(sizes, dir)
+			t += rng.Float64() * gap
+		}
+		dir = -dir
+	}
+	return
+}
+
+func sameFeatures(a, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if math.Abs(a[i]-b[i]) > 1e-9*math.Max(1, math.Abs(a[i])) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStreamMatchesExtract(t *testing.T) {
+	outgoing := func(n int) (times []float64, sizes []int) {
+		for i := 0; i < n; i++ {
+			times, sizes = append(times, float64(i)*0.01), append(sizes, 1)
+		}
+		return
+	}
+	tests := []struct {
+		name         string
+		times        []float64
+		sizes        []int
+		prefixLength int
+	}{
+		{"one cell", []float64{0}, []int{-1}, 1},
+		{"two cells", []float64{0, 0.5}, []int{1, -1}, 1},
+		{"only outgoing", nil, nil, 100},
+		{"short bursts", nil, nil, 50},
+		{"long bursts", nil, nil, 333},
+		{"long trace", nil, nil, 1000},
+	}
+	tests[2].times, tests[2].sizes = outgoing(600)
+	tests[3].times, tests[3].sizes = testTrace(200, 3, 0.05, 1)
+	tests[4].times, tests[4].sizes = testTrace(700, 40, 0.01, 2)
+	tests[5].times, tests[5].sizes = testTrace(5000, 20, 0.002, 3)
+
+	for _, test := range tests {
+		want, err := extractFeatures(test.times, test.sizes)
+		if err != nil {
+			t.Fatalf("%s: extract failed (%s)", test.name, err)
+		}
+		s := newStreamExtractor()
+		for i := range test.times {
+			s.add(test.times[i], test.sizes[i])
+			if i+1 == test.prefixLength {
+				prefix, err := extractFeatures(test.times[:i+1], test.sizes[:i+1])
+				if err != nil {
+					t.Fatalf("%s: extract of prefix failed (%s)", test.name, err)
+				}
+				if !sameFeatures(s.features(), prefix) {
+					t.Errorf("%s: streamed features after %d cells differ from extract",
+						test.name, i+1)
+				}
+			}
+		}
+		if got := s.features(); !sameFeatures(got, want) {
+			t.Errorf("%s: streamed features differ from extract", test.name)
+		}
+	}
+}
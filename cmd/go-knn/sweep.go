@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// SweepAll is the open-world testing size of testing all open-world
+// instances of a fold.
+const SweepAll = -1
+
+var (
+	// sweepTrain are the numbers of unmonitored training sites to also
+	// classify with, nil for no sweep
+	sweepTrain []int
+	// sweepTest are the numbers of unmonitored testing sites to also
+	// evaluate on
+	sweepTest []int
+	// trainSites and testSites are the unmonitored sites of the open-world
+	// instances of the work, numbered in order, in the data learned from and
+	// tested on
+	trainSites, testSites []int
+)
+
+// parseSizes parses comma-separated open-world sizes.
+func parseSizes(list string) (sizes []int, err error) {
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("bad size %q", s)
+		}
+		sizes = append(sizes, n)
+	}
+	return
+}
+
+// parseSweep sets the sizes of the open-world sweep from the flags.
+func parseSweep() (err error) {
+	if sweepTrain, err = parseSizes(*sweepOpen); err != nil {
+		return
+	}
+	if sweepTest, err = parseSizes(*sweepOpenTest); err != nil {
+		return
+	}
+	if len(sweepTest) > 0 && len(sweepTrain) == 0 {
+		return fmt.Errorf("testing sizes need training sizes (-sweep-open)")
+	}
+	if len(sweepTest) == 0 {
+		sweepTest = []int{SweepAll}
+	}
+	return
+}
+
+// sweepName is the attack on the first train unmonitored training and test
+// unmonitored testing sites of a fold.
+func sweepName(attack string, train, test int) string {
+	if test == SweepAll {
+		return fmt.Sprintf("%s/open%d:all", attack, train)
+	}
+	return fmt.Sprintf("%s/open%d:%d", attack, train, test)
+}
+
+// setOpenSites numbers the unmonitored sites of the open-world instances in
+// the files learned from and tested on, monitored first.
+func setOpenSites(files, testFiles []string) {
+	number := func(files []string) []int {
+		numbers := make([]int, len(files)-*sites**instances)
+		for g, group := range openGroups(files, true) {
+			for _, i := range group {
+				numbers[i-*sites**instances] = g
+			}
+		}
+		return numbers
+	}
+	trainSites, testSites = number(files), number(testFiles)
+}
+
+// openRanks are the positions of the sites of the open-world instances among
+// the unmonitored training and testing sites of a fold, math.MaxInt32 if not
+// training or testing, and the numbers of training and testing sites.
+func openRanks(fold, n int) (train, test []int, trained, tested int) {
+	train, test = make([]int, n), make([]int, n)
+	trainRank, testRank := make(map[int]int), make(map[int]int)
+	for j := 0; j < n; j++ {
+		i := *sites**instances + j
+		train[j], test[j] = math.MaxInt32, math.MaxInt32
+		if instanceForTraining(i, fold) {
+			if _, exists := trainRank[trainSites[j]]; !exists {
+				trainRank[trainSites[j]] = len(trainRank)
+			}
+			train[j] = trainRank[trainSites[j]]
+		}
+		if instanceForTesting(i, fold) {
+			if _, exists := testRank[testSites[j]]; !exists {
+				testRank[testSites[j]] = len(testRank)
+			}
+			test[j] = testRank[testSites[j]]
+		}
+	}
+	return train, test, len(trainRank), len(testRank)
+}
+
+// checkSweep checks that every fold has as many unmonitored training and
+// testing sites as swept.
+func checkSweep(folds, n int) error {
+	for fold := 0; fold < folds; fold++ {
+		_, _, trained, tested := openRanks(fold, n)
+		for _, size := range sweepTrain {
+			if size > trained {
+				return fmt.Errorf("fold %d has %d unmonitored training sites, less than %d",
+					fold, trained, size)
+			}
+		}
+		for _, size := range sweepTest {
+			if size > tested {
+				return fmt.Errorf("fold %d has %d unmonitored testing sites, less than %d",
+					fold, tested, size)
+			}
+		}
+	}
+	return nil
+}
+
+// sweep adds the results of instance i, with distances distList to the
+// training instances of the fold, for each swept open-world size.
+func sweep(result map[string]metrics, i, fold int, distList []float64, m Metric) {
+	monitored := *sites * *instances
+	trainRank, testRank, _, _ := openRanks(fold, len(distList)-monitored)
+	trueclass := classOf(i)
+	for _, train := range sweepTrain {
+		d := append([]float64(nil), distList...)
+		for j := monitored; j < len(d); j++ {
+			if trainRank[j-monitored] >= train {
+				d[j] = math.MaxFloat64
+			}
+		}
+		var classes []int
+		for _, index := range nearest(d, *wKmax) {
+			classes = append(classes, classOf(index))
+		}
+		for _, test := range sweepTest {
+			if i >= monitored && test != SweepAll && testRank[i-monitored] >= test {
+				continue // not among the unmonitored sites tested
+			}
+			for k := *wKmin; k <= *wKmax; k += *wKstep {
+				result[sweepName(attackName(k, m), train, test)] =
+					getResult(getkNNClass(classes, trueclass, k), trueclass)
+			}
+		}
+	}
+}
+
+// writeSweep writes the metrics of each attack by the numbers of unmonitored
+// training and testing sites.
+func writeSweep(results []map[string][]metrics, // work -> map["attack"] -> [folds]metrics
+	subfold []string, name string) {
+	out := bytes.NewBufferString("work,attack,open-train-sites,open-test-sites,recall,precision,f1score,fpr,accuracy\n")
+	for sub := 0; sub < len(subfold); sub++ {
+		for _, m := range distMetrics {
+			for k := *wKmin; k <= *wKmax; k += *wKstep {
+				for _, train := range sweepTrain {
+					for _, test := range sweepTest {
+						r, exists := results[sub][sweepName(attackName(k, m), train, test)]
+						if !exists {
+							continue
+						}
+						size := "all"
+						if test != SweepAll {
+							size = strconv.Itoa(test)
+						}
+						str2buf(fmt.Sprintf("%s,%s,%d,%s,%.3f,%.3f,%.3f,%.3f,%.3f\n",
+							csvField(subfold[sub]), attackName(k, m), train, size,
+							recall(r), precision(r), f1score(r), fpr(r), accuracy(r)), out)
+					}
+				}
+			}
+		}
+	}
+	writeFile(out.String(), name)
+}
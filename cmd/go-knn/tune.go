@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// tuning is the hyperparameters chosen for WLLCC in a fold, with the mean
+// accuracy they had in the nested cross-validation.
+type tuning struct {
+	params wllccParams
+	score  float64
+}
+
+// defaultParams are the WLLCC hyperparameters given as flags.
+func defaultParams() wllccParams {
+	return wllccParams{
+		rate:    *weightRate,
+		reco:    *recoPoints,
+		initMin: *weightInitMin,
+		initMax: *weightInitMax,
+	}
+}
+
+// checkParams checks WLLCC hyperparameters, with the number of training
+// instances per site to find the good neighbours among if known (positive).
+func checkParams(p wllccParams, training int) error {
+	if p.rate <= 0 {
+		return fmt.Errorf("learning rate has to be positive, got %f", p.rate)
+	}
+	if p.reco < 1 {
+		return fmt.Errorf("need at least one good/bad neighbour, got %d", p.reco)
+	}
+	if p.initMin < 0 || p.initMin > p.initMax {
+		return fmt.Errorf("invalid initial weight range [%f, %f]", p.initMin, p.initMax)
+	}
+	if training > 0 && p.reco >= training {
+		return fmt.Errorf("%d good neighbours need more than the %d training instances per site",
+			p.reco, training)
+	}
+	return nil
+}
+
+// siteTraining is the smallest number of training instances of a monitored
+// site in any fold.
+func siteTraining(folds int) int {
+	min := math.MaxInt32
+	for fold := 0; fold < folds; fold++ {
+		for site := 0; site < *sites; site++ {
+			n := 0
+			for i := site * *instances; i < (site+1)**instances; i++ {
+				if instanceForTraining(i, fold) {
+					n++
+				}
+			}
+			if n < min {
+				min = n
+			}
+		}
+	}
+	return min
+}
+
+// checkReco checks that WLLCC has more training instances of every site than
+// good neighbours in each fold, and in each inner fold of the candidates when
+// tuning.
+func checkReco(folds int, candidates []wllccParams) error {
+	training := siteTraining(folds)
+	if *tune == "" {
+		return checkParams(defaultParams(), training)
+	}
+	inner := innerTraining(training)
+	for _, c := range candidates {
+		if err := checkParams(c, inner); err != nil {
+			return fmt.Errorf("in the inner folds, %s", err)
+		}
+	}
+	return nil
+}
+
+// tuneCandidates returns the hyperparameters to consider when tuning WLLCC:
+// the full grid of the tune* flags, or for random search tuneTrials
+// candidates sampled from the ranges spanned by the tune* flags.
+func tuneCandidates() (candidates []wllccParams, err error) {
+	rates, err := parseFloatList(*tuneRate)
+	if err != nil {
+		return nil, fmt.Errorf("bad learning rates (%s)", err)
+	}
+	recos, err := parseIntList(*tuneReco)
+	if err != nil {
+		return nil, fmt.Errorf("bad neighbour counts (%s)", err)
+	}
+	var inits [][2]float64
+	for _, r := range strings.Split(*tuneInit, ",") {
+		bounds := strings.Split(strings.TrimSpace(r), ":")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("bad initial weight range %q, expected min:max", r)
+		}
+		min, err := strconv.ParseFloat(bounds[0], 64)
+		if err != nil {
+			return nil, err
+		}
+		max, err := strconv.ParseFloat(bounds[1], 64)
+		if err != nil {
+			return nil, err
+		}
+		inits = append(inits, [2]float64{min, max})
+	}
+
+	switch *tune {
+	case "grid":
+		for _, rate := range rates {
+			for _, reco := range recos {
+				for _, init := range inits {
+					candidates = append(candidates,
+						wllccParams{rate: rate, reco: reco, initMin: init[0], initMax: init[1]})
+				}
+			}
+		}
+	case "random":
+		minRate, maxRate := spanFloat(rates)
+		minReco, maxReco := spanInt(recos)
+		for i := 0; i < *tuneTrials; i++ {
+			init := inits[rand.Intn(len(inits))]
+			candidates = append(candidates, wllccParams{
+				// log-uniform, learning rates span orders of magnitude
+				rate: math.Exp(math.Log(minRate) +
+					rand.Float64()*(math.Log(maxRate)-math.Log(minRate))),
+				reco:    minReco + rand.Intn(maxReco-minReco+1),
+				initMin: init[0],
+				initMax: init[1],
+			})
+		}
+	default:
+		return nil, fmt.Errorf("unknown tuning mode %q (supported: grid, random)", *tune)
+	}
+
+	for _, c := range candidates {
+		if err := checkParams(c, 0); err != nil {
+			return nil, err
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("no candidates to tune")
+	}
+	return
+}
+
+// innerTraining is the fewest training instances of a site with n training
+// instances in the inner folds: innerFolds deals them round-robin, so the
+// first inner fold tests on the most of them.
+func innerTraining(n int) int {
+	return n - (n+*tuneFolds-1) / *tuneFolds
+}
+
+// innerFolds splits the training instances of a fold into n inner folds, per
+// site for the monitored instances. Each returned slice marks the testing
+// instances of an inner fold, indexed as in holdOut.
+func innerFolds(feat, openfeat [][]float64, fold, n int) (inner [][]bool) {
+	inner = make([][]bool, n)
+	for i := 0; i < n; i++ {
+		inner[i] = make([]bool, len(feat)+len(openfeat))
+	}
+	assign := func(candidates []int) {
+		for c, p := range rand.Perm(len(candidates)) {
+			inner[c%n][candidates[p]] = true
+		}
+	}
+
+	for site := 0; site < *sites; site++ {
+		var candidates []int
+		for j := site * *instances; j < (site+1)**instances; j++ {
+			if instanceForTraining(j, fold) {
+				candidates = append(candidates, j)
+			}
+		}
+		assign(candidates)
+	}
+	var candidates []int
+	for j := 0; j < len(openfeat); j++ {
+		if instanceForTraining(len(feat)+j, fold) {
+			candidates = append(candidates, len(feat)+j)
+		}
+	}
+	assign(candidates)
+
+	return
+}
+
+// tuneWLLCC picks the candidate hyperparameters with the best mean accuracy
+// in nested cross-validation on the training instances of a fold.
+func tuneWLLCC(ctx context.Context, feat, openfeat [][]float64, fold int, m Metric,
+	candidates []wllccParams) (best tuning) {
+	inner := innerFolds(feat, openfeat, fold, *tuneFolds)
+	best.score = math.Inf(-1)
+	for _, c := range candidates {
+		if ctx.Err() != nil {
+			return
+		}
+		var score float64
+		for i := 0; i < len(inner); i++ {
+			weight, _ := wllcc(ctx, feat, openfeat, fold, m, c, inner[i])
+			acc := heldOutAccuracy(feat, openfeat, weight, m, fold, inner[i], inner[i])
+			if !math.IsNaN(acc) {
+				score += acc
+			}
+		}
+		score /= float64(len(inner))
+		if score > best.score {
+			best = tuning{params: c, score: score}
+		}
+	}
+	return
+}
+
+func spanFloat(values []float64) (min, max float64) {
+	min, max = values[0], values[0]
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+	}
+	return
+}
+
+func spanInt(values []int) (min, max int) {
+	min, max = values[0], values[0]
+	for _, v := range values {
+		if v < min {
+			min = v
+		}
+		if v > max {
+			max = v
+		}
+	}
+	return
+}